@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminStatus is the reply to GET /status on the admin API.
+type adminStatus struct {
+	// Active are the active commands, from the oldest to the newest.
+	Active          []adminCmd     `json:"active"`
+	Current         adminCmd       `json:"current"`
+	Next            adminCmd       `json:"next"`
+	Release         string         `json:"release,omitempty"`
+	PreviousRelease string         `json:"previous_release,omitempty"`
+	Rotation        *adminRotation `json:"rotation"`
+	Stopping        bool           `json:"stopping"`
+}
+
+type adminCmd struct {
+	Param    string     `json:"param"`
+	Running  bool       `json:"running"`
+	PID      int        `json:"pid,omitempty"`
+	Started  *time.Time `json:"started,omitempty"`
+	Restarts int        `json:"restarts"`
+}
+
+type adminRotation struct {
+	Param       string    `json:"param"`
+	Release     string    `json:"release,omitempty"`
+	Step        int       `json:"step"`
+	Steps       int       `json:"steps"`
+	Started     time.Time `json:"started"`
+	Overlapping bool      `json:"overlapping"`
+}
+
+// adminReply is the reply to the POST requests on the admin API.
+type adminReply struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+func newAdminStatus(s *state) adminStatus {
+	st := adminStatus{
+		Release:         s.release,
+		PreviousRelease: s.previousRelease,
+		Stopping:        s.stopping,
+	}
+	for _, p := range s.active() {
+		st.Active = append(st.Active, newAdminCmd(s, p))
+	}
+	currentParam, _ := s.current()
+	nextParam, _ := s.next()
+	st.Current, st.Next = newAdminCmd(s, currentParam), newAdminCmd(s, nextParam)
+	if t := s.transition; t != nil {
+		st.Rotation = &adminRotation{t.param, t.release, t.step, t.steps, t.started.UTC(),
+			t.overlapping}
+	}
+	return st
+}
+
+func newAdminCmd(s *state, param string) adminCmd {
+	c := adminCmd{Param: param, Restarts: s.restarts[param]}
+	if cmd := s.cmd(param); cmd != nil && cmd.Process != nil {
+		started := s.started[param].UTC()
+		c.Running, c.PID, c.Started = true, cmd.Process.Pid, &started
+	}
+	return c
+}
+
+// listenAdmin listens on address, which is either the path of a Unix socket, or a TCP address that
+// must be on the loopback interface since the admin API has no authentication.
+func listenAdmin(address string) (net.Listener, error) {
+	if isUnixAddress(address) {
+		return listenControl(address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// isUnixAddress returns true if address is the path of a Unix socket rather than a TCP address.
+func isUnixAddress(address string) bool {
+	return strings.Contains(address, "/")
+}
+
+// checkAdminAddress returns an error if address is neither the path of a Unix socket nor a TCP
+// address on the loopback interface.
+func checkAdminAddress(address string) error {
+	if isUnixAddress(address) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("host %q is not a loopback address", host)
+	}
+	return nil
+}
+
+// serveAdmin serves the admin API on l until l is closed. GET /status requests are forwarded on
+// status, and POST /rotate and /stop requests on control, like the commands of the control
+// socket. done must be closed when status and control stop being read.
+func serveAdmin(l net.Listener, control chan controlRequest, status chan chan adminStatus,
+	done chan struct{}) {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSON(w, http.StatusMethodNotAllowed, adminReply{false, "use GET"})
+			return
+		}
+		reply := make(chan adminStatus, 1)
+		select {
+		case status <- reply:
+			select {
+			case st := <-reply:
+				writeJSON(w, http.StatusOK, st)
+				return
+			case <-done:
+			}
+		case <-done:
+		}
+		writeJSON(w, http.StatusServiceUnavailable, adminReply{false, exitingMessage})
+	})
+	mux.HandleFunc("/rotate", func(w http.ResponseWriter, r *http.Request) {
+		command := "rotate"
+		if wait := r.URL.Query().Get("wait"); wait == "false" || wait == "0" {
+			command += " -nowait"
+		}
+		if release := r.URL.Query().Get("release"); release != "" {
+			if strings.ContainsAny(release, " \t\n") {
+				writeJSON(w, http.StatusBadRequest, adminReply{false,
+					fmt.Sprintf("invalid release %q", release)})
+				return
+			}
+			command += " -release " + release
+		}
+		handleAdminCommand(w, r, command, control, done)
+	})
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		handleAdminCommand(w, r, "stop", control, done)
+	})
+	http.Serve(l, mux)
+}
+
+// handleAdminCommand sends the control command for a POST request, and writes the reply.
+func handleAdminCommand(w http.ResponseWriter, r *http.Request, command string,
+	control chan controlRequest, done chan struct{}) {
+
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, adminReply{false, "use POST"})
+		return
+	}
+	sendControlRequest(command, control, done, func(reply controlReply) {
+		code := http.StatusOK
+		if reply.message == exitingMessage {
+			code = http.StatusServiceUnavailable
+		} else if !reply.ok {
+			code = http.StatusConflict
+		}
+		writeJSON(w, code, adminReply{reply.ok, reply.message})
+		// Send the reply right away rather than when the handler returns, which may be after
+		// alternate has exited.
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
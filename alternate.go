@@ -4,148 +4,742 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
-	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
-type runFunc func(param string) (*exec.Cmd, error)
+type runFunc func(param, release string) (*exec.Cmd, error)
+
+// Exit codes of alternate, besides the exit codes of the commands.
+const (
+	exitClean = 0
+	// exitStartFailed is returned when alternate could not start, or could not run a command.
+	exitStartFailed = 125
+	// exitKilled is returned after sending a KILL signal to all commands, as if alternate itself
+	// had been killed.
+	exitKilled = 128 + int(syscall.SIGKILL)
+)
+
+// options holds the optional settings of alternate. Use newOptions to get the default settings.
+type options struct {
+	// shell runs the command through /bin/sh instead of splitting it into words.
+	shell bool
+	// prefix is the list of fields, among prefixTime, prefixParam and prefixPID, that precede each
+	// line written by the commands. Empty for no prefix.
+	prefix []string
+	// logFormat is the format of the alternate logs: logFormatText or logFormatJSON.
+	logFormat string
+	// logFile is the template of the path of the file that the output of each command is written
+	// to, with the placeholders expanded for the parameter and the start time, or empty to write
+	// the output to cmdStdout and cmdStderr.
+	logFile string
+	// logMaxSize is the size in bytes after which a log file is rotated, or 0 to never rotate.
+	logMaxSize int64
+	// logKeep is the number of rotated log files to keep, or 0 to keep them all.
+	logKeep int
+	// logCompress is true if the rotated log files are compressed with gzip.
+	logCompress bool
+	// env is the list of KEY=VALUE environment variables, with the placeholders expanded for the
+	// parameter, added to the environment of the commands.
+	env []string
+	// dir is the working directory, with the placeholders expanded for the parameter, of the
+	// commands. Empty to use the working directory of alternate.
+	dir string
+	// releases is the directory containing the releases that the commands are run from, each in
+	// its own subdirectory named after the release identifier. Empty to disable releases.
+	releases string
+	// release is the identifier of the release that the first command is run from.
+	release string
+	// instances is the number of commands that run concurrently, each with its own parameter. A
+	// rotation replaces them one at a time, from the oldest to the newest, and halts at the first
+	// replacement that is rolled back.
+	instances int
+	// restart is the restart policy of the active commands that exit: restartNever, restartOnFailure
+	// or restartAlways.
+	restart string
+	// restartDelay is the delay before the first restart of a command, doubled for each restart
+	// within restartWindow, up to restartMaxDelay.
+	restartDelay    time.Duration
+	restartMaxDelay time.Duration
+	// restartLimit is the maximum number of restarts of a command within restartWindow, after which
+	// it is not restarted anymore. 0 for no limit.
+	restartLimit  int
+	restartWindow time.Duration
+	// killOrphans makes the commands receive a KILL signal when alternate exits, even if it is
+	// killed. Only supported on Linux.
+	killOrphans bool
+	// stopSignal is the signal sent to the commands to stop them.
+	stopSignal syscall.Signal
+	// stopTimeout is how long to wait for a command to exit after sending it the stop signal,
+	// before sending a KILL signal to it and its process group. 0 to wait forever.
+	stopTimeout time.Duration
+	// rotateSignal is the signal that starts a rotation when received by alternate.
+	rotateSignal syscall.Signal
+	// forward is the list of signals that are forwarded to the active commands when received by
+	// alternate.
+	forward []signalMapping
+	// httpProbe is the URL, with the placeholder replaced by the next parameter, that must return a
+	// 2xx status code before the overlap duration starts and the current command is terminated.
+	// Empty to disable probing.
+	httpProbe string
+	// tcpProbe is the address, with the placeholder replaced by the next parameter, that must accept
+	// a TCP connection before the overlap duration starts and the current command is terminated.
+	// Empty to disable probing.
+	tcpProbe string
+	// probeTimeout is how long to wait for the next command to become ready before rolling back the
+	// rotation.
+	probeTimeout time.Duration
+	// probeInterval is the delay between two probe attempts.
+	probeInterval time.Duration
+	// httpProxy is the address to listen on for HTTP requests to forward to the upstream of the
+	// current command. Empty to disable the embedded HTTP proxy.
+	httpProxy string
+	// tcpProxy is the address to listen on for TCP connections to forward to the upstream of the
+	// current command. Empty to disable the embedded TCP proxy.
+	tcpProxy string
+	// upstream is the address, with the placeholder replaced by the current parameter, that the
+	// embedded proxies forward to.
+	upstream string
+	// listen is the list of addresses to open listening sockets on. The sockets are passed to every
+	// command using the systemd socket activation protocol.
+	listen []string
+	// controlSocket is the path of the Unix socket to listen on for control commands. Empty to
+	// disable the control socket.
+	controlSocket string
+	// metrics is the address to listen on for HTTP requests to /metrics, which returns metrics in
+	// the Prometheus text format. Empty to disable the metrics endpoint.
+	metrics string
+	// admin is the loopback TCP address or the path of the Unix socket to listen on for requests to
+	// the HTTP admin API. Empty to disable the admin API.
+	admin string
+}
+
+func newOptions() options {
+	return options{
+		logFormat:       logFormatText,
+		instances:       1,
+		restart:         restartNever,
+		restartDelay:    time.Second,
+		restartMaxDelay: 30 * time.Second,
+		restartLimit:    5,
+		restartWindow:   time.Minute,
+		stopSignal:      syscall.SIGTERM,
+		rotateSignal:    syscall.SIGUSR1,
+		probeTimeout:    30 * time.Second,
+		probeInterval:   time.Second,
+	}
+}
 
 // testKill is a channel that is used during testing only to trigger an immediate cleanup and return
 // from the alternate function.
 var testKill chan struct{}
 
 // alternate runs a command with alternating parameters inserted in place of the placeholder. Each
-// time a USR1 signal is received, a new command is run with the next parameter, and a TERM signal
-// is sent to the previous command after the overlap duration has elapsed. The alternate logs are
-// written to stderr, and the command logs are written to cmdStdout and cmdStderr.
-func alternate(command, placeholder string, params []string, overlap time.Duration, stderr,
-	cmdStdout, cmdStderr io.Writer) {
-
-	setupLog(stderr)
-	log.Printf("Starting with command %q, placeholder %q, params = %q, overlap = %v\n",
+// time the rotate signal is received, a new command is run with the next parameter, and the stop
+// signal is sent to the previous command after the overlap duration has elapsed. If the next
+// command exits before taking over, the rotation is rolled back: the next command is terminated and
+// the previous command keeps running. The other behaviors, such as readiness probes, instances and
+// restarts, are set in opts. The alternate logs are written to stderr, and the command logs are
+// written to cmdStdout and cmdStderr unless opts sets a log file.
+//
+// alternate returns its exit code once all commands have exited: exitClean after a shutdown
+// requested with a TERM or INT signal or the stop control command, the exit code of the last active
+// command that exited on its own otherwise, or exitStartFailed if a command could not be started.
+func alternate(command, placeholder string, params []string, overlap time.Duration, opts options,
+	stderr, cmdStdout, cmdStderr io.Writer) int {
+
+	l := newLogger(stderr, opts.logFormat)
+	l.event("start", fields{"command": command, "params": params,
+		"overlap_ms": milliseconds(overlap)},
+		"Starting with command %q, placeholder %q, params = %q, overlap = %v\n",
 		command, placeholder, params, overlap)
 
-	terminate := make(chan os.Signal)
-	cmdExit := make(chan string)
-	overlapEnd := make(chan struct{})
-	rotate := make(chan os.Signal)
+	terminate := make(chan os.Signal, 1)
+	cmdExit := make(chan exitEvent)
+	overlapEnd := make(chan *transition)
+	ready := make(chan readiness)
+	rotate := make(chan os.Signal, 1)
+	restart := make(chan string)
+	control := make(chan controlRequest)
+	metricsRequests := make(chan chan string)
+	statusRequests := make(chan chan adminStatus)
+	// Before exiting, wait for the replies to the control requests to be written, once done is
+	// closed so that the requests still waiting for a reply give up.
+	var replies sync.WaitGroup
+	defer replies.Wait()
+	done := make(chan struct{})
+	defer close(done)
 
 	// Listen to TERM signal (termination signal sent programmatically by e.g. supervisord) and
 	// INT signal (termination signal sent when the user presses Ctrl-C in the terminal).
 	signal.Notify(terminate, syscall.SIGTERM, syscall.SIGINT)
 
-	signal.Notify(rotate, syscall.SIGUSR1)
+	signal.Notify(rotate, opts.rotateSignal)
+
+	forward := make(chan os.Signal, 1)
+	for _, m := range opts.forward {
+		signal.Notify(forward, m.from)
+	}
+
+	// Reopen the log files of the commands on HUP signal, after logrotate moved them.
+	reopen := make(chan os.Signal, 1)
+	logs := newLogFiles(l, opts.logMaxSize, opts.logKeep, opts.logCompress)
+	if opts.logFile != "" {
+		signal.Notify(reopen, syscall.SIGHUP)
+	}
+
+	files, err := listenFiles(opts.listen)
+	if err != nil {
+		l.errorf(err, "Failed to open listening sockets %q, error: %v\n", opts.listen, err)
+		return exitStartFailed
+	}
+	defer closeFiles(files)
+	if len(files) > 0 {
+		l.printf("Passing listening sockets %q to all commands\n", opts.listen)
+	}
+
+	syncStdout, syncStderr := newSyncWriter(cmdStdout), newSyncWriter(cmdStderr)
+
+	// Convenience closure for easily running a command with a given parameter, from a given
+	// release if releases are used.
+	runFunc := func(param, release string) (*exec.Cmd, error) {
+		command, dir, env := command, opts.dir, opts.env
+		if opts.releases != "" {
+			rd, err := releaseDir(opts.releases, release)
+			if err != nil {
+				return nil, err
+			}
+			if dir == "" {
+				dir = rd
+			}
+			command, dir = expandRelease(command, rd), expandRelease(dir, rd)
+			env = make([]string, len(opts.env))
+			for i, e := range opts.env {
+				env[i] = expandRelease(e, rd)
+			}
+		}
+
+		s := expand(command, placeholder, param)
+		c, err := cmd(s, opts.shell, syncStdout, syncStderr)
+		if err != nil {
+			return nil, err
+		}
+		// Write the output of the command one whole line at a time, so that the lines of
+		// concurrent commands do not merge.
+		prefix := cmdPrefix(opts.prefix, param, c)
+		c.Stdout, c.Stderr = newPrefixWriter(syncStdout, prefix), newPrefixWriter(syncStderr, prefix)
+		if opts.logFile != "" {
+			p := expandStart(expand(opts.logFile, placeholder, param), time.Now())
+			f, err := logs.open(p)
+			if err != nil {
+				return nil, fmt.Errorf("cannot open log file: %v", err)
+			}
+			c.Stdout, c.Stderr = newPrefixWriter(f, prefix), newPrefixWriter(f, prefix)
+		}
+		c.Dir = expand(dir, placeholder, param)
+		c.SysProcAttr = sysProcAttr(opts.killOrphans)
+		if len(env) > 0 {
+			c.Env = append(os.Environ(), expandAll(env, placeholder, param)...)
+		}
+		inheritFiles(c, files)
+		if err := runCmd(c, param, cmdExit); err != nil {
+			closeLogFile(c)
+			return nil, err
+		}
+		return c, nil
+	}
+
+	var probe probeFunc
+	if opts.httpProbe != "" {
+		l.printf("Using HTTP readiness probe %q\n", opts.httpProbe)
+		probe = httpProbe(opts.httpProbe, placeholder)
+	} else if opts.tcpProbe != "" {
+		l.printf("Using TCP readiness probe %q\n", opts.tcpProbe)
+		probe = tcpProbe(opts.tcpProbe, placeholder)
+	}
+
+	s := newState(params, opts.instances)
+	k := newTerminator(l, opts.stopSignal, opts.stopTimeout, done)
+	r := newRestarter(opts)
+
+	// Convenience closure for scheduling the restart of the active command with param, if the
+	// restart policy wants it.
+	scheduleRestart := func(param string, failed bool) {
+		if s.stopping || !s.isActive(param) || !r.wants(failed) {
+			return
+		}
+		d, err := r.schedule(param, time.Now())
+		if err != nil {
+			l.event("restart_given_up", fields{"param": param, "error": err},
+				"Not restarting command with parameter %q, error: %v\n", param, err)
+			return
+		}
+		l.event("restart_scheduled", fields{"param": param, "delay_ms": milliseconds(d)},
+			"Restarting command with parameter %q in %v\n", param, d)
+		go restartAfter(d, param, restart, done)
+	}
+
+	// Convenience closure for running the next parameter from the given release, as the given step
+	// of a rotation that started at the given time. If the command cannot be run, the result is
+	// reported to waiters and nil is returned.
+	beginStep := func(step int, started time.Time, release string,
+		waiters ...chan controlReply) *transition {
+
+		nextParam, _ := s.next()
+		if opts.instances > 1 {
+			l.printf("Replacing instance %d of %d with parameter %q\n", step, opts.instances,
+				nextParam)
+		}
+		l.event("rotate_start", fields{"param": nextParam, "release": release, "step": step,
+			"steps": opts.instances}, "Rotating to parameter %q\n", nextParam)
+		if err := run(l, s, nextParam, release, runFunc); err != nil {
+			var d time.Duration
+			if step == 1 {
+				// The rotation never started, so it has no duration.
+				s.metrics.rotationFailedToStart()
+			} else {
+				d = time.Since(started)
+				s.metrics.rotationEnded(rotationFailed, d)
+			}
+			report(l, rotationResult{nextParam, rotationFailed,
+				haltReason(err.Error(), step, opts.instances), nil, d}, waiters...)
+			return nil
+		}
+		t := s.begin(nextParam, release, s.cmd(nextParam))
+		t.step, t.steps, t.started, t.waiters = step, opts.instances, started, waiters
+		return t
+	}
+
+	var finishStep func()
 
-	// Convenience closure for easily running a command with a given parameter.
-	runFunc := func(param string) (*exec.Cmd, error) {
-		log.Printf("Running command with parameter %q\n", param)
-		s := strings.Replace(command, placeholder, param, 1)
-		c := cmd(s, cmdStdout, cmdStderr)
-		return c, runCmd(c, param, cmdExit)
+	// Convenience closure for waiting for the overlap duration before finishing the current step.
+	startOverlap := func() {
+		if overlap == 0 {
+			finishStep()
+			return
+		}
+		s.transition.overlapping = true
+		currentParam, _ := s.current()
+		l.event("overlap_start", fields{"param": currentParam, "overlap_ms": milliseconds(overlap)},
+			"Waiting %v before sending %s signal to command with parameter %q\n",
+			overlap, signalName(opts.stopSignal), currentParam)
+		go countdown(overlap, s.transition, overlapEnd)
 	}
 
-	s := newState(params)
+	// Convenience closure for waiting for the next command of t to become ready if a probe is set,
+	// then for the overlap duration.
+	awaitStep := func(t *transition) {
+		if probe != nil {
+			l.printf("Waiting up to %v for command with parameter %q to become ready\n",
+				opts.probeTimeout, t.param)
+			go waitReady(l, probe, t, opts.probeInterval, opts.probeTimeout, ready)
+		} else {
+			startOverlap()
+		}
+	}
 
-	// Run the first command.
-	currentParam, _ := s.current()
-	if err := run(s, currentParam, runFunc); err != nil {
-		log.Println(err.Error())
-		return
+	// finishStep makes the next command take over from the current command, then ends the rotation
+	// if all instances have been replaced, or starts the next step otherwise.
+	finishStep = func() {
+		t := s.transition
+		takeOver(s, k)
+		if t.step == t.steps {
+			endRotation(l, s, rotationSucceeded, "")
+			return
+		}
+		l.printf("Replaced %d of %d instances\n", t.step, t.steps)
+		s.end()
+		// The duration of the rotation includes all its steps.
+		if next := beginStep(t.step+1, t.started, t.release, t.waiters...); next != nil {
+			awaitStep(next)
+		}
+	}
+
+	// Convenience closure for starting a rotation to the next parameter, run from the given
+	// release, or from the current release if empty. reply, if not nil, receives the result of the
+	// rotation once it ends if wait is true, or as soon as it has started otherwise. Rotations are
+	// rejected once alternate is stopping.
+	startRotation := func(reply chan controlReply, wait bool, release string) {
+		if s.stopping {
+			l.printf("Ignoring rotation since alternate is stopping\n")
+			if reply != nil {
+				reply <- controlReply{false, "alternate is stopping"}
+			}
+			return
+		}
+		if s.rotating() {
+			report(l, rotationResult{s.transition.param, rotationInProgress, "", nil, 0}, reply)
+			return
+		}
+
+		if release == "" {
+			release = s.release
+		}
+		t := beginStep(1, time.Now(), release, reply)
+		if t == nil {
+			return
+		}
+		if reply != nil && !wait {
+			t.waiters = nil
+			reply <- controlReply{true, fmt.Sprintf("Rotation to parameter %q started", t.param)}
+		}
+		awaitStep(t)
+	}
+
+	if opts.controlSocket != "" {
+		ln, err := listenControl(opts.controlSocket)
+		if err != nil {
+			l.errorf(err, "Failed to listen on control socket %q, error: %v\n",
+				opts.controlSocket, err)
+			return exitStartFailed
+		}
+		defer ln.Close()
+		l.printf("Listening for control commands on %q\n", opts.controlSocket)
+		go serveControl(ln, control, done)
+	}
+
+	if opts.metrics != "" {
+		ln, err := net.Listen("tcp", opts.metrics)
+		if err != nil {
+			l.errorf(err, "Failed to listen on metrics address %q, error: %v\n", opts.metrics, err)
+			return exitStartFailed
+		}
+		defer ln.Close()
+		l.printf("Serving metrics on http://%s/metrics\n", ln.Addr())
+		go serveMetrics(ln, metricsRequests, done)
+	}
+
+	if opts.admin != "" {
+		ln, err := listenAdmin(opts.admin)
+		if err != nil {
+			l.errorf(err, "Failed to listen on admin address %q, error: %v\n", opts.admin, err)
+			return exitStartFailed
+		}
+		defer ln.Close()
+		l.printf("Serving admin API on %q\n", opts.admin)
+		go serveAdmin(ln, control, statusRequests, done)
+	}
+
+	if opts.httpProxy != "" {
+		ln, err := net.Listen("tcp", opts.httpProxy)
+		if err != nil {
+			l.errorf(err, "Failed to listen on HTTP proxy address %q, error: %v\n",
+				opts.httpProxy, err)
+			return exitStartFailed
+		}
+		defer ln.Close()
+		l.printf("Forwarding HTTP requests from %q to upstream %q\n", opts.httpProxy,
+			opts.upstream)
+		p := newHTTPProxy(l, opts.upstream, placeholder)
+		s.watch(p.switchTo)
+		go p.serve(ln)
+	}
+
+	if opts.tcpProxy != "" {
+		ln, err := net.Listen("tcp", opts.tcpProxy)
+		if err != nil {
+			l.errorf(err, "Failed to listen on TCP proxy address %q, error: %v\n",
+				opts.tcpProxy, err)
+			return exitStartFailed
+		}
+		defer ln.Close()
+		l.printf("Forwarding TCP connections from %q to upstream %q\n", opts.tcpProxy,
+			opts.upstream)
+		p := newTCPProxy(l, opts.upstream, placeholder)
+		s.watch(p.switchTo)
+		go p.serve(ln)
+	}
+
+	// Run the first commands.
+	for _, p := range s.active() {
+		if err := run(l, s, p, opts.release, runFunc); err != nil {
+			l.errorf(err, "%v", err)
+			signalAllCmds(l, s, syscall.SIGKILL)
+			return exitStartFailed
+		}
+	}
+	s.setRelease(opts.release)
+
+	// Exit code of the last active command that exited.
+	code := exitClean
+
+	// finished returns true once alternate can exit: all commands have exited, no restart is
+	// pending unless alternate is stopping, in which case the pending restarts are dropped, and no
+	// process is left in the group of a command waiting for its stop timeout to be killed.
+	finished := func() bool {
+		return s.empty() && (s.stopping || r.pending == 0) && !k.groupsRunning()
 	}
 
 	// Event loop.
 	for {
 		select {
 		case <-testKill:
-			log.Println("testKill channel received a value, sending KILL signal to all commands " +
+			l.printf("testKill channel received a value, sending KILL signal to all commands " +
 				"and exiting alternate")
-			signalAllCmds(s, syscall.SIGKILL)
-			return
+			signalAllCmds(l, s, syscall.SIGKILL)
+			return exitKilled
 
-		case <-terminate:
-			log.Println("Received TERM or INT signal, sending TERM signal to all commands, will " +
-				"exit after all commands have exited")
-			signalAllCmds(s, syscall.SIGTERM)
+		case sig := <-terminate:
+			name := signalName(sig.(syscall.Signal))
+			l.event("signal_received", fields{"signal": name}, "Received %s signal, sending %s "+
+				"signal to all commands, will exit after all commands have exited\n", name,
+				signalName(opts.stopSignal))
+			stop(l, s, k)
+			if finished() {
+				l.event("exit", nil, "All commands have exited, exiting alternate")
+				return exitCode(s, code)
+			}
 
-		case param := <-cmdExit:
-			log.Printf("Command with parameter %q exited\n", param)
-			s.unset(param)
-			if s.empty() {
-				log.Println("All commands have exited, exiting alternate")
-				return
+		case e := <-cmdExit:
+			l.event("cmd_exit", e.fields(), "Command with parameter %q exited with %s, %s\n",
+				e.param, e, e.usage())
+			if s.isActive(e.param) {
+				code = e.exitCode()
+			}
+			s.unset(e.param)
+			s.metrics.exited(e.param, e.exitCode())
+			if s.rotating() && s.transition.param == e.param {
+				s.transition.exit = &e
+				rollback(l, s, k, fmt.Sprintf("command exited with %s before taking over", e))
+			} else {
+				scheduleRestart(e.param, e.err != nil)
+			}
+			if finished() {
+				l.event("exit", nil, "All commands have exited, exiting alternate")
+				return exitCode(s, code)
 			}
 
-		case <-overlapEnd:
-			finishRotation(s)
+		case t := <-k.expired:
+			delete(k.pending, t.cmd)
+			// Even if the command has already exited, the processes it started may still be running
+			// in its process group, for example if a wrapper script exited on the stop signal but
+			// its children ignored it.
+			if s.cmd(t.param) == t.cmd || groupRunning(t.cmd) {
+				l.event("kill_sent", fields{"param": t.param, "pid": t.cmd.Process.Pid},
+					"Command with parameter %q is still running %v after the %s signal, sending "+
+						"KILL signal\n", t.param, opts.stopTimeout, signalName(opts.stopSignal))
+				if err := signalCmd(t.cmd, syscall.SIGKILL); err != nil {
+					l.errorf(err, "Failed to send KILL signal to command with parameter %q, "+
+						"error: %v\n", t.param, err)
+				}
+			}
+			if finished() {
+				l.event("exit", nil, "All commands have exited, exiting alternate")
+				return exitCode(s, code)
+			}
+
+		case t := <-overlapEnd:
+			if t == s.transition {
+				finishStep()
+			}
+
+		case p := <-restart:
+			r.pending--
+			if !s.stopping && s.isActive(p) && s.cmd(p) == nil {
+				if err := run(l, s, p, s.release, runFunc); err != nil {
+					l.errorf(err, "%v", err)
+					code = exitStartFailed
+					scheduleRestart(p, true)
+				} else {
+					s.restarted(p)
+					l.event("cmd_restart", fields{"param": p, "restarts": s.restarts[p]},
+						"Restarted command with parameter %q, %d restarts so far\n", p,
+						s.restarts[p])
+				}
+			}
+			if finished() {
+				l.event("exit", nil, "All commands have exited, exiting alternate")
+				return exitCode(s, code)
+			}
+
+		case sig := <-forward:
+			for _, m := range opts.forward {
+				if m.from != sig {
+					continue
+				}
+				for _, p := range s.active() {
+					if c := s.cmd(p); c != nil {
+						l.event("signal_forwarded", fields{"param": p, "pid": c.Process.Pid,
+							"signal": signalName(m.from), "as": signalName(m.to)},
+							"Forwarding %s signal as %s to command with parameter %q\n",
+							signalName(m.from), signalName(m.to), p)
+						signalCmd(c, m.to)
+					}
+				}
+			}
+
+		case <-reopen:
+			l.event("signal_received", fields{"signal": "HUP"},
+				"Received HUP signal, reopening the log files of the commands\n")
+			logs.reopen()
 
 		case <-rotate:
 			nextParam, _ := s.next()
-			log.Printf("Received signal USR1, rotating to next parameter %q", nextParam)
+			l.event("signal_received", fields{"signal": signalName(opts.rotateSignal)},
+				"Received signal %s, rotating to next parameter %q",
+				signalName(opts.rotateSignal), nextParam)
+			startRotation(nil, false, "")
 
-			if err := run(s, nextParam, runFunc); err != nil {
-				log.Println(err.Error())
+		case reply := <-metricsRequests:
+			reply <- s.metrics.render(s, time.Now())
+
+		case reply := <-statusRequests:
+			reply <- newAdminStatus(s)
+
+		case req := <-control:
+			replies.Add(1)
+			go func() {
+				<-req.written
+				replies.Done()
+			}()
+			l.event("control_command", fields{"command": req.command},
+				"Received control command %q\n", req.command)
+			cc, err := parseControlCommand(req.command)
+			if err != nil {
+				req.reply <- controlReply{false, err.Error()}
 				break
 			}
+			switch cc.name {
+			case "rotate":
+				if cc.release != "" && opts.releases == "" {
+					req.reply <- controlReply{false, "releases are not enabled"}
+					break
+				}
+				startRotation(req.reply, cc.wait, cc.release)
+			case "rollback":
+				if s.previousRelease == "" {
+					req.reply <- controlReply{false, "no previous release to roll back to"}
+					break
+				}
+				l.printf("Rolling back to previous release %q\n", s.previousRelease)
+				startRotation(req.reply, cc.wait, s.previousRelease)
+			case "status":
+				req.reply <- controlReply{true, statusMessage(s)}
+			case "stop":
+				l.printf("Sending %s signal to all commands, will exit after all commands "+
+					"have exited\n", signalName(opts.stopSignal))
+				stop(l, s, k)
+				req.reply <- controlReply{true, fmt.Sprintf("sent %s signal to all commands",
+					signalName(opts.stopSignal))}
+				if finished() {
+					l.event("exit", nil, "All commands have exited, exiting alternate")
+					return exitCode(s, code)
+				}
+			case "kill":
+				l.printf("Sending KILL signal to all commands and exiting alternate")
+				signalAllCmds(l, s, syscall.SIGKILL)
+				req.reply <- controlReply{true, "sent KILL signal to all commands"}
+				return exitKilled
+			}
 
-			if overlap == 0 {
-				finishRotation(s)
+		case r := <-ready:
+			if r.transition != s.transition {
+				// The transition that was probed has already ended.
+				break
+			}
+			if r.err != nil {
+				rollback(l, s, k, r.err.Error())
 			} else {
-				currentParam, _ := s.current()
-				log.Printf("Waiting %v before sending TERM signal to command with parameter %q\n",
-					overlap, currentParam)
-				go countdown(overlap, overlapEnd)
+				startOverlap()
 			}
 		}
 	}
 }
 
-func finishRotation(s *state) {
-	if _, c := s.next(); c == nil {
-		// The next command is not running. Cancel the rotation.
-		return
+// exitCode returns the exit code of alternate once all commands have exited, given the exit code
+// of the last active command that exited.
+func exitCode(s *state, code int) int {
+	if s.stopping {
+		return exitClean
+	}
+	return code
+}
+
+// stop cancels the rotation in progress if any, and sends the stop signal to all commands. The
+// pending restarts are not run, and alternate exits without waiting for them.
+func stop(l *logger, s *state, k *terminator) {
+	s.stopping = true
+	if s.rotating() {
+		endRotation(l, s, rotationCancelled, "alternate is terminating")
+	}
+	s.each(k.terminate)
+}
+
+// takeOver makes the next command of the transition replace the current command, which is
+// terminated.
+func takeOver(s *state, k *terminator) {
+	// Rotate before terminating the current command, so that the embedded proxy has already
+	// switched to the next command by the time the current command stops accepting requests.
+	p, c := s.current()
+	if t, ok := s.started[s.transition.param]; ok {
+		s.metrics.overlap += time.Since(t)
 	}
-	terminateCurrentCmd(s)
 	s.rotate()
+	s.setRelease(s.transition.release)
+	k.terminate(p, c)
 }
 
-func run(s *state, param string, runFunc runFunc) error {
+// rollback terminates the next command instead of the current one, and keeps the rotation
+// unchanged.
+func rollback(l *logger, s *state, k *terminator, reason string) {
+	if p, c := s.next(); c != nil {
+		l.printf("Rolling back rotation to parameter %q\n", p)
+		k.terminate(p, c)
+	}
+	endRotation(l, s, rotationRolledBack, reason)
+}
+
+func endRotation(l *logger, s *state, outcome rotationOutcome, reason string) {
+	t := s.transition
+	s.end()
+	if outcome != rotationSucceeded {
+		reason = haltReason(reason, t.step, t.steps)
+	}
+	d := time.Since(t.started)
+	s.metrics.rotationEnded(outcome, d)
+	report(l, rotationResult{t.param, outcome, reason, t.exit, d}, t.waiters...)
+}
+
+func run(l *logger, s *state, param, release string, runFunc runFunc) error {
 	if c := s.cmd(param); c != nil {
 		return fmt.Errorf("A command with parameter %q is already running, cannot run again",
 			param)
 	}
 
-	c, err := runFunc(param)
+	c, err := runFunc(param, release)
 	if err != nil {
-		return fmt.Errorf("Failed to run the command with parameter %q, error: %v\n",
+		return fmt.Errorf("Failed to run the command with parameter %q, error: %v",
 			param, err.Error())
 	}
 
 	s.set(param, c)
-	return nil
-}
-
-func terminateCurrentCmd(s *state) {
-	if p, c := s.current(); c != nil {
-		log.Printf("Sending TERM signal to command with parameter %q\n", p)
-		if err := signalCmd(c, syscall.SIGTERM); err != nil {
-			log.Printf("Failed to send TERM signal to command with parameter %q, error: %v\n",
-				p, err)
-		}
+	f := fields{"param": param, "pid": c.Process.Pid}
+	if release != "" {
+		f["release"] = release
+		l.event("cmd_start", f, "Running command with parameter %q from release %q, pid %d\n",
+			param, release, c.Process.Pid)
+	} else {
+		l.event("cmd_start", f, "Running command with parameter %q, pid %d\n", param,
+			c.Process.Pid)
 	}
+	return nil
 }
 
-func signalAllCmds(s *state, sig os.Signal) {
+func signalAllCmds(l *logger, s *state, sig os.Signal) {
 	s.each(func(p string, c *exec.Cmd) {
-		log.Printf("Sending signal to command with parameter %q\n", p)
+		l.printf("Sending signal to command with parameter %q\n", p)
 		signalCmd(c, sig)
 	})
 }
 
+// signalCmd sends sig to the command, and to all the processes of its process group if the command
+// leads its own group, so that the processes started by a wrapper script are signalled too. The
+// process group is signalled even if the command itself has already exited.
 func signalCmd(c *exec.Cmd, sig os.Signal) error {
 	if c == nil {
 		return errors.New("signalCmd error: cmd is nil")
@@ -154,40 +748,84 @@ func signalCmd(c *exec.Cmd, sig os.Signal) error {
 	if process == nil {
 		return errors.New("signalCmd error: cmd.Process is nil")
 	}
-	process.Signal(sig)
-	return nil
+	if s, ok := sig.(syscall.Signal); ok {
+		if pgid := processGroup(c); pgid > 0 {
+			return syscall.Kill(-pgid, s)
+		}
+	}
+	return process.Signal(sig)
 }
 
-func countdown(d time.Duration, end chan struct{}) {
-	time.Sleep(d)
-	end <- struct{}{}
+// processGroup returns the ID of the process group led by the started command c, or 0 if c does
+// not lead its own group. The ID is known from the start of the command, so it stays valid after
+// the command has exited, as long as other processes remain in the group.
+func processGroup(c *exec.Cmd) int {
+	if a := c.SysProcAttr; a != nil && a.Setpgid && a.Pgid == 0 {
+		return c.Process.Pid
+	}
+	return 0
 }
 
-// cmd returns a command built from the given string. The command prints to the given stdout and
-// stderr.
-func cmd(s string, stdout, stderr io.Writer) *exec.Cmd {
-	f := strings.Fields(s)
-	c := exec.Command(f[0], f[1:]...)
+// groupRunning returns true if processes remain in the process group led by the started command c.
+func groupRunning(c *exec.Cmd) bool {
+	pgid := processGroup(c)
+	return pgid > 0 && syscall.Kill(-pgid, 0) != syscall.ESRCH
+}
+
+func countdown(d time.Duration, t *transition, end chan *transition) {
+	select {
+	case <-time.After(d):
+		end <- t
+	case <-t.done:
+	}
+}
+
+// cmd returns a command built from the given string, split into words with shell quoting rules, or
+// run by /bin/sh if shell is true. The command prints to the given stdout and stderr.
+func cmd(s string, shell bool, stdout, stderr io.Writer) (*exec.Cmd, error) {
+	var c *exec.Cmd
+	if shell {
+		c = exec.Command("/bin/sh", "-c", s)
+	} else {
+		f, err := splitWords(s)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse command %q: %v", s, err)
+		}
+		if len(f) == 0 {
+			return nil, errors.New("empty command")
+		}
+		c = exec.Command(f[0], f[1:]...)
+	}
 	c.Stdout = stdout
 	c.Stderr = stderr
-	return c
+	return c, nil
 }
 
-// runCmd runs a command without blocking. After the command exits, runCmd sends msg on the exit
-// channel.
-func runCmd(c *exec.Cmd, msg string, exit chan string) error {
+// runCmd runs a command without blocking. After the command exits, runCmd flushes its output, and
+// sends an exit event for param on the exit channel.
+func runCmd(c *exec.Cmd, param string, exit chan exitEvent) error {
+	start := time.Now()
 	if err := c.Start(); err != nil {
 		return err
 	}
 	go func() {
-		c.Wait()
-		exit <- msg
+		err := c.Wait()
+		for _, w := range []io.Writer{c.Stdout, c.Stderr} {
+			if f, ok := w.(*prefixWriter); ok {
+				f.Flush()
+			}
+		}
+		closeLogFile(c)
+		exit <- exitEvent{param, err, c.ProcessState, time.Since(start)}
 	}()
 	return nil
 }
 
-func setupLog(output io.Writer) {
-	log.SetPrefix("alternate | ")
-	log.SetOutput(output)
-	log.SetFlags(0)
+// closeLogFile closes the log file that the command c writes its output to, if any.
+func closeLogFile(c *exec.Cmd) {
+	if w, ok := c.Stdout.(*prefixWriter); ok {
+		if f, ok := w.w.(*logFile); ok {
+			f.Close()
+		}
+	}
 }
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -95,6 +103,7 @@ type test struct {
 	cmdStderr   *lineWriter
 	params      []string
 	exited      bool
+	code        int
 	expectIndex int
 }
 
@@ -160,6 +169,11 @@ func newTest(t *testing.T, params []string, overlap time.Duration) *test {
 
 func newTestWithCommand(t *testing.T, params []string, overlap time.Duration,
 	command string) *test {
+	return newTestWithOptions(t, params, overlap, command, newOptions())
+}
+
+func newTestWithOptions(t *testing.T, params []string, overlap time.Duration, command string,
+	opts options) *test {
 	test := &test{
 		t,
 		newLineWriter(false),
@@ -167,10 +181,11 @@ func newTestWithCommand(t *testing.T, params []string, overlap time.Duration,
 		params,
 		false,
 		0,
+		0,
 	}
 	go func() {
-		alternate(command, placeholder, params, overlap, newNilWriter(), test.cmdStdout,
-			test.cmdStderr)
+		test.code = alternate(command, placeholder, params, overlap, opts, newNilWriter(),
+			test.cmdStdout, test.cmdStderr)
 		test.exited = true
 	}()
 	return test
@@ -480,6 +495,44 @@ func TestPrematureNextCmdExit(t *testing.T) {
 	}
 }
 
+func TestRollbackOnPrematureNextCmdExit(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := three
+
+	a := testbin.SetBehavior(-one, zero, "a")
+	test := newTest(t, params, overlap)
+	test.expect(one, []string{
+		"param0 " + a + " | start",
+	})
+
+	// The next command exits before taking over, so the rotation is rolled back right away and a
+	// new rotation can start without waiting for the end of the overlap.
+	b := testbin.SetBehavior(zero, zero, "b")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		"param1 " + b + " | start",
+		"param1 " + b + " | exit",
+	})
+
+	c := testbin.SetBehavior(-one, zero, "c")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		"param1 " + c + " | start",
+	})
+
+	// The overlap of the rolled back rotation must not end the new rotation early.
+	test.reset()
+	test.expect(one+one/2, []string{})
+	test.reset()
+	test.expect(one, []string{
+		"param0 " + a + " | exit",
+	})
+
+	kill()
+}
+
 func TestCmdRunError(t *testing.T) {
 	paramsList := [][]string{
 		{"param0", "param1"},
@@ -527,6 +580,248 @@ func TestFirstCmdRunError(t *testing.T) {
 	if !test.exited {
 		t.Error("Was expecting exited to be true, was false")
 	}
+	if test.code != exitStartFailed {
+		t.Errorf("Was expecting exit code %d, was %d", exitStartFailed, test.code)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		iCommand string
+		oCode    int
+	}{
+		{"exit 0", 0},
+		{"exit 3", 3},
+		{"kill -KILL $$", 128 + int(syscall.SIGKILL)},
+	}
+
+	for i, tt := range tests {
+		opts := newOptions()
+		opts.shell = true
+		test := newTestWithOptions(t, []string{"param0"}, zero, tt.iCommand, opts)
+		time.Sleep(one)
+		if !test.exited {
+			t.Errorf("For test #%d with command %q, was expecting exited to be true, was false",
+				i, tt.iCommand)
+		} else if test.code != tt.oCode {
+			t.Errorf("For test #%d with command %q, was expecting exit code %d, was %d", i,
+				tt.iCommand, tt.oCode, test.code)
+		}
+	}
+}
+
+func TestQuotedCmd(t *testing.T) {
+	params := []string{"param0"}
+	overlap := zero
+
+	a := testbin.SetBehavior(-one, zero, "a")
+	command := testbin.Build() + ` "quoted ` + placeholder + `" 'single\' escaped\ space`
+	test := newTestWithCommand(t, params, overlap, command)
+	test.expect(one, []string{
+		"quoted param0 single\\ escaped space " + a + " | start",
+	})
+
+	kill()
+}
+
+func TestNamedPlaceholders(t *testing.T) {
+	params := []string{"port=3000,admin=9000", "port=3001,admin=9001"}
+	overlap := zero
+
+	a := testbin.SetBehavior(-one, zero, "a")
+	command := testbin.Build() + " -port %{port} -admin %{admin} -again %{port}"
+	test := newTestWithCommand(t, params, overlap, command)
+	test.expect(one, []string{
+		"-port 3000 -admin 9000 -again 3000 " + a + " | start",
+	})
+
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		"-port 3001 -admin 9001 -again 3001 " + b + " | start",
+		"-port 3000 -admin 9000 -again 3000 " + a + " | exit",
+	})
+
+	kill()
+}
+
+func TestStopTimeoutProcessGroup(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := zero
+
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := newOptions()
+	opts.shell = true
+	opts.stopTimeout = two
+
+	// The commands are wrapper scripts that exit on the TERM signal, but whose children ignore it
+	// and create a file if they are still running after a while.
+	file := path.Join(dir, placeholder)
+	command := "(trap '' TERM; sleep 0.4; touch " + file + ") >/dev/null 2>&1 & " +
+		"trap 'exit 0' TERM; sleep 10 & wait"
+	newTestWithOptions(t, params, overlap, command, opts)
+	time.Sleep(one)
+
+	// The children of the command with param0 are killed after the stop timeout of the rotation,
+	// even though the command itself has already exited.
+	sendUsr1()
+	time.Sleep(10 * one)
+	if _, err := os.Stat(path.Join(dir, "param0")); !os.IsNotExist(err) {
+		t.Errorf("Expected the children of the command with param0 to be killed, but got error %v",
+			err)
+	}
+
+	kill()
+}
+
+func TestStopTimeoutProcessGroupOnShutdown(t *testing.T) {
+	params := []string{"param0"}
+	overlap := zero
+
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := newOptions()
+	opts.shell = true
+	opts.stopTimeout = two
+
+	// The command is a wrapper script that exits on the TERM signal, but whose child ignores it
+	// and creates a file if it is still running after a while.
+	file := path.Join(dir, placeholder)
+	command := "(trap '' TERM; sleep 0.4; touch " + file + ") >/dev/null 2>&1 & " +
+		"trap 'exit 0' TERM; sleep 10 & wait"
+	test := newTestWithOptions(t, params, overlap, command, opts)
+	time.Sleep(one)
+
+	// alternate waits for the stop timeout to kill the child before exiting, even though the
+	// command itself has already exited.
+	sendTerm()
+	time.Sleep(one)
+	if test.exited {
+		t.Error("Was expecting exited to be false, was true")
+	}
+	time.Sleep(two)
+	if !test.exited {
+		t.Error("Was expecting exited to be true, was false")
+	}
+	time.Sleep(five)
+	if _, err := os.Stat(path.Join(dir, "param0")); !os.IsNotExist(err) {
+		t.Errorf("Expected the child of the command to be killed, but got error %v", err)
+	}
+}
+
+func TestShellCmd(t *testing.T) {
+	params := []string{"param0"}
+	overlap := zero
+
+	opts := newOptions()
+	opts.shell = true
+
+	command := "echo $0 " + placeholder + " | tr a-z A-Z 1>&2"
+	test := newTestWithOptions(t, params, overlap, command, opts)
+	time.Sleep(one)
+	if lines := test.cmdStderr.getLines(); !sameStrings(lines, []string{"/BIN/SH PARAM0"}) {
+		t.Errorf("Expected shell command to print %q, was %q", "/BIN/SH PARAM0", lines)
+	}
+	if !test.exited {
+		t.Error("Was expecting exited to be true, was false")
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := two
+
+	opts := newOptions()
+	opts.prefix = []string{prefixParam}
+
+	a := testbin.SetBehavior(-one, zero, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one, []string{
+		"param0 | param0 " + a + " | start",
+	})
+
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		"param1 | param1 " + b + " | start",
+	})
+
+	kill()
+}
+
+func TestLogFile(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := zero
+
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := newOptions()
+	opts.shell = true
+	opts.prefix = []string{prefixParam}
+	opts.logFile = path.Join(dir, placeholder+".log")
+
+	command := "echo out " + placeholder + "; sleep 0.01; echo err " + placeholder +
+		" >&2; sleep 10"
+	test := newTestWithOptions(t, params, overlap, command, opts)
+	time.Sleep(one)
+	sendUsr1()
+	time.Sleep(one)
+
+	for _, p := range params {
+		b, err := ioutil.ReadFile(path.Join(dir, p+".log"))
+		expected := p + " | out " + p + "\n" + p + " | err " + p + "\n"
+		if string(b) != expected {
+			t.Errorf("Expected log file of %s to contain %q, was %q (error %v)", p, expected,
+				string(b), err)
+		}
+	}
+	if lines := test.cmdStdout.getLines(); len(lines) > 0 {
+		t.Errorf("Expected no output on stdout, was %q", lines)
+	}
+
+	kill()
+}
+
+func TestEnvAndDir(t *testing.T) {
+	params := []string{"port=3000,slot=blue"}
+	overlap := zero
+
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(path.Join(dir, "blue"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := newOptions()
+	opts.shell = true
+	opts.env = []string{"PORT=%{port}", "SLOT=%{slot}", "PARAM=" + placeholder}
+	opts.dir = path.Join(dir, "%{slot}")
+
+	command := "echo $PORT $SLOT $PARAM $(pwd)"
+	test := newTestWithOptions(t, params, overlap, command, opts)
+	time.Sleep(one)
+	expected := []string{"3000 blue port=3000,slot=blue " + path.Join(dir, "blue")}
+	if lines := test.cmdStdout.getLines(); !sameStrings(lines, expected) {
+		t.Errorf("Expected command to print %q, was %q", expected, lines)
+	}
 }
 
 func TestAllCmdsExit(t *testing.T) {
@@ -551,6 +846,68 @@ func TestAllCmdsExit(t *testing.T) {
 	}
 }
 
+func TestRestart(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := zero
+
+	opts := newOptions()
+	opts.restart = restartAlways
+	opts.restartDelay = one
+	opts.restartLimit = 2
+
+	// The command exits right away, and is restarted after one, then two units of time, then not
+	// anymore since the limit is reached.
+	a := testbin.SetBehavior(zero, zero, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one/2, []string{
+		"param0 " + a + " | start",
+		"param0 " + a + " | exit",
+	})
+
+	test.reset()
+	test.expect(one, []string{
+		"param0 " + a + " | start",
+		"param0 " + a + " | exit",
+	})
+
+	test.reset()
+	test.expect(one, []string{})
+
+	test.reset()
+	test.expect(two, []string{
+		"param0 " + a + " | start",
+		"param0 " + a + " | exit",
+	})
+	if !test.exited {
+		t.Error("Was expecting exited to be true, was false")
+	}
+}
+
+func TestRestartDroppedOnStop(t *testing.T) {
+	params := []string{"param0", "param1", "param2"}
+	overlap := zero
+
+	opts := newOptions()
+	opts.shell = true
+	opts.instances = 2
+	opts.restart = restartAlways
+	opts.restartDelay = 20 * five
+
+	// The command with param0 exits right away, and its restart is pending when alternate is
+	// stopped. alternate exits as soon as the command with param1 has exited.
+	command := "if [ " + placeholder + " = param0 ]; then exit 1; fi; sleep 10"
+	test := newTestWithOptions(t, params, overlap, command, opts)
+	time.Sleep(one)
+	sendTerm()
+	time.Sleep(two)
+	if !test.exited {
+		t.Error("Was expecting exited to be true, was false")
+	}
+	if test.code != exitClean {
+		t.Errorf("Expected exit code %d, was %d", exitClean, test.code)
+	}
+}
+
 func TestTermForwarding(t *testing.T) {
 	params := []string{"param0"}
 	overlap := zero
@@ -578,4 +935,848 @@ func TestTermForwarding(t *testing.T) {
 	if !test.exited {
 		t.Error("Was expecting exited to be true, was false")
 	}
+	if test.code != exitClean {
+		t.Errorf("Was expecting exit code %d, was %d", exitClean, test.code)
+	}
+}
+
+func TestSignals(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := zero
+
+	opts := newOptions()
+	opts.shell = true
+	opts.stopSignal = syscall.SIGQUIT
+	opts.rotateSignal = syscall.SIGUSR2
+	opts.forward = []signalMapping{{syscall.SIGHUP, syscall.SIGWINCH}}
+
+	// The command prints the signals it receives, and only exits on QUIT. The sleep runs in the
+	// background, where QUIT is ignored, so that only the shell handles the signals sent to the
+	// process group.
+	command := `say() { echo "$@"; echo "$@" 1>&2; }; ` +
+		`trap "say ` + placeholder + ` quit; exit" QUIT; ` +
+		`trap "say ` + placeholder + ` winch" WINCH; ` +
+		`say ` + placeholder + ` start; while :; do sleep 0.01 & wait; done`
+	test := newTestWithOptions(t, params, overlap, command, opts)
+	test.expect(one, []string{
+		"param0 start",
+	})
+
+	test.reset()
+	process().Signal(syscall.SIGHUP)
+	test.expect(one, []string{
+		"param0 winch",
+	})
+
+	test.reset()
+	process().Signal(syscall.SIGUSR2)
+	test.expect(one, []string{
+		"param1 start",
+		"param0 quit",
+	})
+
+	test.reset()
+	sendTerm()
+	test.expect(one, []string{
+		"param1 quit",
+	})
+	if !test.exited {
+		t.Error("Was expecting exited to be true, was false")
+	}
+}
+
+func TestProcessGroup(t *testing.T) {
+	params := []string{"param0"}
+	overlap := zero
+
+	opts := newOptions()
+	opts.shell = true
+
+	// The shell exits on TERM without forwarding it, so the testbin only receives it because it
+	// is in the same process group.
+	a := testbin.SetBehavior(-one, zero, "a")
+	command := testbin.Build() + " " + placeholder + " & wait"
+	test := newTestWithOptions(t, params, overlap, command, opts)
+	test.expect(one, []string{
+		"param0 " + a + " | start",
+	})
+
+	test.reset()
+	sendTerm()
+	test.expect(one, []string{
+		"param0 " + a + " | exit",
+	})
+	if !test.exited {
+		t.Error("Was expecting exited to be true, was false")
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := zero
+
+	opts := newOptions()
+	opts.stopTimeout = two
+
+	// The commands ignore the TERM signal.
+	a := testbin.SetBehavior(-one, -one, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one, []string{
+		"param0 " + a + " | start",
+	})
+
+	// The command with param0 is killed after the stop timeout of the rotation.
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		"param1 " + b + " | start",
+	})
+	test.reset()
+	test.expect(two, []string{})
+
+	// Since the command with param0 was killed, alternate exits as soon as the command with param1
+	// exits.
+	test.reset()
+	sendTerm()
+	test.expect(one, []string{
+		"param1 " + b + " | exit",
+	})
+	if !test.exited {
+		t.Error("Was expecting exited to be true, was false")
+	}
+}
+
+func TestStopTimeoutOnShutdown(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := zero
+
+	opts := newOptions()
+	opts.stopTimeout = two
+
+	// The command ignores the TERM signal.
+	a := testbin.SetBehavior(-one, -one, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one, []string{
+		"param0 " + a + " | start",
+	})
+
+	test.reset()
+	sendTerm()
+	test.expect(one, []string{})
+	if test.exited {
+		t.Error("Was expecting exited to be false, was true")
+	}
+	test.expect(two, []string{})
+	if !test.exited {
+		t.Error("Was expecting exited to be true, was false")
+	}
+	if test.code != exitClean {
+		t.Errorf("Was expecting exit code %d, was %d", exitClean, test.code)
+	}
+}
+
+func TestInterruptSignalLog(t *testing.T) {
+	params := []string{"param0"}
+	overlap := zero
+
+	opts := newOptions()
+	opts.logFormat = logFormatJSON
+
+	stderr := newLineWriter(false)
+	testbin.SetBehavior(-one, zero, "a")
+	go alternate(testbin.Build()+" "+placeholder, placeholder, params, overlap, opts, stderr,
+		newNilWriter(), newNilWriter())
+	time.Sleep(one)
+
+	// The event reports the signal that was actually received.
+	process().Signal(syscall.SIGINT)
+	time.Sleep(one)
+	event := ""
+	for _, line := range stderr.getLines() {
+		if strings.Contains(line, `"type":"signal_received"`) {
+			event = line
+		}
+	}
+	if !strings.Contains(event, `"signal":"INT"`) || !strings.Contains(event, "Received INT signal") {
+		t.Errorf("Expected a signal_received event reporting INT, was %q", event)
+	}
+}
+
+func TestHTTPProbe(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := zero
+
+	var param1Ready int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/param1" && atomic.LoadInt32(&param1Ready) == 1 {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	opts := newOptions()
+	opts.httpProbe = server.URL + "/" + placeholder
+	opts.probeTimeout = three
+	opts.probeInterval = one / 5
+
+	a := testbin.SetBehavior(-one, zero, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one, []string{
+		"param0 " + a + " | start",
+	})
+
+	// The next command is not ready yet, so the current command must keep running.
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		"param1 " + b + " | start",
+	})
+
+	atomic.StoreInt32(&param1Ready, 1)
+	test.reset()
+	test.expect(one, []string{
+		"param0 " + a + " | exit",
+	})
+
+	// The next command never becomes ready, so it must be terminated instead of the current one.
+	c := testbin.SetBehavior(-one, zero, "c")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		"param0 " + c + " | start",
+	})
+	test.reset()
+	test.expect(three, []string{
+		"param0 " + c + " | exit",
+	})
+
+	kill()
+}
+
+func TestTCPProbe(t *testing.T) {
+	params := []string{freePort(t), freePort(t)}
+	overlap := zero
+
+	opts := newOptions()
+	opts.tcpProbe = "127.0.0.1:" + placeholder
+	opts.probeTimeout = three
+	opts.probeInterval = one / 5
+
+	a := testbin.SetBehavior(-one, zero, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one, []string{
+		params[0] + " " + a + " | start",
+	})
+
+	// Nothing listens on the next port yet, so the current command must keep running.
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		params[1] + " " + b + " | start",
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:"+params[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	test.reset()
+	test.expect(one, []string{
+		params[0] + " " + a + " | exit",
+	})
+
+	// Nothing ever listens on the next port, so the next command must be terminated.
+	c := testbin.SetBehavior(-one, zero, "c")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		params[0] + " " + c + " | start",
+	})
+	test.reset()
+	test.expect(three, []string{
+		params[0] + " " + c + " | exit",
+	})
+
+	kill()
+}
+
+// freePort returns a TCP port that nothing was listening on at the time of the call.
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func TestControlSocket(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := two
+
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := newOptions()
+	opts.controlSocket = path.Join(dir, "control.sock")
+
+	a := testbin.SetBehavior(-one, zero, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one, []string{
+		"param0 " + a + " | start",
+	})
+
+	expectReply(t, opts.controlSocket, "unknown", `error unknown command "unknown"`)
+
+	// The rotate command only replies once the rotation has ended, and concurrent rotations are
+	// rejected.
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	rotated := make(chan string)
+	go func() {
+		rotated <- sendControl(t, opts.controlSocket, "rotate")
+	}()
+	test.expect(one, []string{
+		"param1 " + b + " | start",
+	})
+	expectReply(t, opts.controlSocket, "rotate",
+		`error Rotation to parameter "param1" already in progress`)
+
+	test.reset()
+	if reply := <-rotated; reply != `ok Rotation to parameter "param1" succeeded` {
+		t.Errorf("Expected rotate reply to be a success, was %q", reply)
+	}
+	test.expect(one, []string{
+		"param0 " + a + " | exit",
+	})
+
+	status := sendControl(t, opts.controlSocket, "status")
+	if !strings.HasPrefix(status, `ok current parameter "param1" (pid `) ||
+		!strings.HasSuffix(status, `), next parameter "param0" (not running)`) {
+		t.Errorf("Unexpected status reply %q", status)
+	}
+
+	test.reset()
+	expectReply(t, opts.controlSocket, "stop", "ok sent TERM signal to all commands")
+	test.expect(one, []string{
+		"param1 " + b + " | exit",
+	})
+	if !test.exited {
+		t.Error("Was expecting exited to be true, was false")
+	}
+}
+
+func TestControlRotateWhileStopping(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := zero
+
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := newOptions()
+	opts.controlSocket = path.Join(dir, "control.sock")
+
+	// The command takes a while to exit after the TERM signal.
+	a := testbin.SetBehavior(-one, two, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one, []string{
+		"param0 " + a + " | start",
+	})
+
+	// Once stopping, rotations are rejected instead of starting a new command.
+	test.reset()
+	expectReply(t, opts.controlSocket, "stop", "ok sent TERM signal to all commands")
+	expectReply(t, opts.controlSocket, "rotate", "error alternate is stopping")
+	sendUsr1()
+	test.expect(three, []string{
+		"param0 " + a + " | exit",
+	})
+	if !test.exited {
+		t.Error("Was expecting exited to be true, was false")
+	}
+}
+
+func TestInstances(t *testing.T) {
+	params := []string{"param0", "param1", "param2", "param3"}
+	overlap := two
+
+	opts := newOptions()
+	opts.instances = 2
+
+	a := testbin.SetBehavior(-one, zero, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one, []string{
+		"param0 " + a + " | start",
+		"param1 " + a + " | start",
+	})
+
+	// The instances are replaced one at a time, from the oldest to the newest.
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		"param2 " + b + " | start",
+	})
+	test.reset()
+	test.expect(two, []string{
+		"param0 " + a + " | exit",
+		"param3 " + b + " | start",
+	})
+	test.reset()
+	test.expect(two, []string{
+		"param1 " + a + " | exit",
+	})
+
+	c := testbin.SetBehavior(-one, zero, "c")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		"param0 " + c + " | start",
+	})
+
+	kill()
+}
+
+func TestInstancesHalt(t *testing.T) {
+	params := []string{"param0", "param1", "param2", "param3"}
+	overlap := two
+
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := newOptions()
+	opts.instances = 2
+	opts.shell = true
+	opts.controlSocket = path.Join(dir, "control.sock")
+
+	// The command with param3 exits right away, so the second replacement is rolled back.
+	command := "[ " + placeholder + " != param3 ] || exit 1; exec " + testbin.Build() + " " +
+		placeholder
+	a := testbin.SetBehavior(-one, zero, "a")
+	test := newTestWithOptions(t, params, overlap, command, opts)
+	test.expect(one, []string{
+		"param0 " + a + " | start",
+		"param1 " + a + " | start",
+	})
+
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	reply := sendControl(t, opts.controlSocket, "rotate")
+	if !strings.HasPrefix(reply, `error Rotation to parameter "param3" rolled back, reason: `+
+		`command exited with exit status 1 before taking over, roll-out halted after replacing `+
+		`1 of 2 instances (next command ran for `) {
+		t.Errorf("Unexpected rotate reply %q", reply)
+	}
+	test.expect(one, []string{
+		"param2 " + b + " | start",
+		"param0 " + a + " | exit",
+	})
+
+	status := sendControl(t, opts.controlSocket, "status")
+	if !strings.HasPrefix(status, `ok active parameters "param1" (pid `) ||
+		!strings.Contains(status, `, "param2" (pid `) ||
+		!strings.HasSuffix(status, `), next parameter "param3" (not running)`) {
+		t.Errorf("Unexpected status reply %q", status)
+	}
+
+	kill()
+}
+
+func TestReleases(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := zero
+
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, r := range []string{"v1", "v2"} {
+		if err := os.Mkdir(path.Join(dir, r), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := newOptions()
+	opts.controlSocket = path.Join(dir, "control.sock")
+	opts.releases = dir
+	opts.release = "v1"
+	v1, v2 := path.Join(dir, "v1"), path.Join(dir, "v2")
+
+	a := testbin.SetBehavior(-one, zero, "a")
+	command := testbin.Build() + " " + placeholder + " " + releasePlaceholder
+	test := newTestWithOptions(t, params, overlap, command, opts)
+	test.expect(one, []string{
+		"param0 " + v1 + " " + a + " | start",
+	})
+
+	expectReply(t, opts.controlSocket, "rollback", "error no previous release to roll back to")
+	expectReply(t, opts.controlSocket, "rotate -release v3", `error Rotation to parameter `+
+		`"param1" failed, reason: Failed to run the command with parameter "param1", error: `+
+		`release "v3" not found: stat `+path.Join(dir, "v3")+`: no such file or directory`)
+
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	expectReply(t, opts.controlSocket, "rotate -release v2",
+		`ok Rotation to parameter "param1" succeeded`)
+	test.expect(one, []string{
+		"param1 " + v2 + " " + b + " | start",
+		"param0 " + v1 + " " + a + " | exit",
+	})
+
+	// Rolling back restarts the previous release in the other slot.
+	c := testbin.SetBehavior(-one, zero, "c")
+	test.reset()
+	expectReply(t, opts.controlSocket, "rollback", `ok Rotation to parameter "param0" succeeded`)
+	test.expect(one, []string{
+		"param0 " + v1 + " " + c + " | start",
+		"param1 " + v2 + " " + b + " | exit",
+	})
+
+	// Rotating without a release keeps the current release.
+	d := testbin.SetBehavior(-one, zero, "d")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		"param1 " + v1 + " " + d + " | start",
+		"param0 " + v1 + " " + c + " | exit",
+	})
+
+	status := sendControl(t, opts.controlSocket, "status")
+	if !strings.HasSuffix(status, `, current release "v1", previous release "v2"`) {
+		t.Errorf("Unexpected status reply %q", status)
+	}
+
+	kill()
+}
+
+// sendControl sends a command on the control socket at the given path, and returns the reply.
+func sendControl(t *testing.T, path, command string) string {
+	reply, err := sendCtlCommand(path, command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func expectReply(t *testing.T, path, command, reply string) {
+	if r := sendControl(t, path, command); r != reply {
+		t.Errorf("For control command %q, expected reply %q, was %q", command, reply, r)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := two
+
+	opts := newOptions()
+	opts.admin = "127.0.0.1:" + freePort(t)
+	url := "http://" + opts.admin
+
+	a := testbin.SetBehavior(-one, zero, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one, []string{
+		"param0 " + a + " | start",
+	})
+
+	var status adminStatus
+	adminRequest(t, "GET", url+"/status", http.StatusOK, &status)
+	if status.Current.Param != "param0" || !status.Current.Running || status.Current.PID == 0 ||
+		status.Next.Param != "param1" || status.Next.Running || status.Rotation != nil {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	adminRequest(t, "GET", url+"/rotate", http.StatusMethodNotAllowed, nil)
+
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	var reply adminReply
+	adminRequest(t, "POST", url+"/rotate?wait=false", http.StatusOK, &reply)
+	if reply != (adminReply{true, `Rotation to parameter "param1" started`}) {
+		t.Errorf("Unexpected rotate reply %+v", reply)
+	}
+	test.expect(one, []string{
+		"param1 " + b + " | start",
+	})
+
+	adminRequest(t, "GET", url+"/status", http.StatusOK, &status)
+	if r := status.Rotation; r == nil || r.Param != "param1" || !r.Overlapping {
+		t.Errorf("Expected an overlapping rotation to param1, was %+v", r)
+	}
+	adminRequest(t, "POST", url+"/rotate", http.StatusConflict, &reply)
+
+	test.reset()
+	test.expect(two, []string{
+		"param0 " + a + " | exit",
+	})
+	adminRequest(t, "GET", url+"/status", http.StatusOK, &status)
+	if status.Current.Param != "param1" || status.Rotation != nil {
+		t.Errorf("Unexpected status after rotation %+v", status)
+	}
+
+	test.reset()
+	adminRequest(t, "POST", url+"/stop", http.StatusOK, &reply)
+	test.expect(one, []string{
+		"param1 " + b + " | exit",
+	})
+	if !test.exited {
+		t.Error("Was expecting exited to be true, was false")
+	}
+}
+
+// adminRequest sends a request to the admin API, checks its status code, and decodes its JSON body
+// into v if v is not nil.
+func adminRequest(t *testing.T, method, url string, code int, v interface{}) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != code {
+		t.Errorf("For %s %s, expected status code %d, was %d", method, url, code,
+			resp.StatusCode)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Errorf("For %s %s, failed to decode the body, error: %v", method, url, err)
+		}
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	var params []string
+	for i := 0; i < 2; i++ {
+		body := fmt.Sprintf("upstream%d", i)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}))
+		defer server.Close()
+		params = append(params, server.Listener.Addr().String())
+	}
+	overlap := two
+
+	opts := newOptions()
+	opts.httpProxy = "127.0.0.1:" + freePort(t)
+	opts.upstream = placeholder
+
+	a := testbin.SetBehavior(-one, zero, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one, []string{
+		params[0] + " " + a + " | start",
+	})
+	expectBody(t, "http://"+opts.httpProxy, "upstream0")
+
+	// The proxy keeps forwarding to the current command during the overlap.
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		params[1] + " " + b + " | start",
+	})
+	expectBody(t, "http://"+opts.httpProxy, "upstream0")
+
+	test.reset()
+	test.expect(two, []string{
+		params[0] + " " + a + " | exit",
+	})
+	expectBody(t, "http://"+opts.httpProxy, "upstream1")
+
+	kill()
+}
+
+func expectBody(t *testing.T, url, body string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != body {
+		t.Errorf("For GET %s, expected body %q, was %q", url, body, b)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	params := []string{"param0", "param1"}
+	overlap := zero
+
+	opts := newOptions()
+	opts.metrics = "127.0.0.1:" + freePort(t)
+
+	a := testbin.SetBehavior(-one, zero, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one, []string{
+		"param0 " + a + " | start",
+	})
+
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		"param1 " + b + " | start",
+		"param0 " + a + " | exit",
+	})
+
+	resp, err := http.Get("http://" + opts.metrics + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	for _, expected := range []string{
+		`alternate_rotations_total{outcome="succeeded"} 1`,
+		`alternate_rotations_total{outcome="rolled_back"} 0`,
+		`alternate_rotation_duration_seconds_count 1`,
+		`alternate_command_exits_total{param="param0",code="0"} 1`,
+		`alternate_active{param="param0"} 0`,
+		`alternate_active{param="param1"} 1`,
+		`alternate_command_uptime_seconds{param="param1"} `,
+	} {
+		if !strings.Contains(string(body), "\n"+expected) {
+			t.Errorf("Expected metrics to contain %q, was:\n%s", expected, body)
+		}
+	}
+
+	kill()
+}
+
+func TestTCPProxy(t *testing.T) {
+	var params []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		go serveEcho(l, fmt.Sprintf("upstream%d", i))
+		params = append(params, l.Addr().String())
+	}
+	overlap := zero
+
+	opts := newOptions()
+	opts.tcpProxy = "127.0.0.1:" + freePort(t)
+	opts.upstream = placeholder
+
+	a := testbin.SetBehavior(-one, -one, "a")
+	test := newTestWithOptions(t, params, overlap, testbin.Build()+" "+placeholder, opts)
+	test.expect(one, []string{
+		params[0] + " " + a + " | start",
+	})
+	oldConn := dialEcho(t, opts.tcpProxy, "upstream0")
+	defer oldConn.Close()
+
+	b := testbin.SetBehavior(-one, zero, "b")
+	test.reset()
+	sendUsr1()
+	test.expect(one, []string{
+		params[1] + " " + b + " | start",
+	})
+
+	// New connections go to the new upstream, while existing connections keep draining to the
+	// old one.
+	newConn := dialEcho(t, opts.tcpProxy, "upstream1")
+	defer newConn.Close()
+	fmt.Fprintln(oldConn, "ping")
+	if line, err := oldConn.ReadString('\n'); err != nil || line != "upstream0 ping\n" {
+		t.Errorf("Expected old connection to echo %q, was %q, error: %v", "upstream0 ping\n",
+			line, err)
+	}
+
+	kill()
+}
+
+type echoConn struct {
+	net.Conn
+	*bufio.Reader
+}
+
+// serveEcho accepts connections on l, greets them with the name, and then echoes every line back
+// prefixed with the name.
+func serveEcho(l net.Listener, name string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			fmt.Fprintln(conn, name)
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				fmt.Fprint(conn, name+" "+line)
+			}
+		}()
+	}
+}
+
+// dialEcho connects to address, and checks that the greeting is the expected name.
+func dialEcho(t *testing.T, address, name string) echoConn {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := echoConn{conn, bufio.NewReader(conn)}
+	if line, err := c.ReadString('\n'); err != nil || line != name+"\n" {
+		t.Errorf("Expected greeting %q from %s, was %q, error: %v", name, address, line, err)
+	}
+	return c
+}
+
+func TestListenFiles(t *testing.T) {
+	params := []string{"param0"}
+	overlap := zero
+
+	opts := newOptions()
+	opts.listen = []string{"127.0.0.1:" + freePort(t)}
+
+	// env prints its environment, then exits.
+	test := newTestWithOptions(t, params, overlap, "env", opts)
+	time.Sleep(one)
+	if !test.exited {
+		t.Error("Was expecting exited to be true, was false")
+	}
+
+	env := test.cmdStdout.getLines()
+	if !containsString(env, "LISTEN_FDS=1") {
+		t.Errorf("Expected LISTEN_FDS=1 in environment %q", env)
+	}
+	for _, e := range env {
+		if strings.HasPrefix(e, "LISTEN_PID=") && e != fmt.Sprintf("LISTEN_PID=%d", os.Getpid()) {
+			return
+		}
+	}
+	t.Errorf("Expected LISTEN_PID to be set to the command pid in environment %q", env)
+}
+
+func containsString(a []string, s string) bool {
+	for _, e := range a {
+		if e == s {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// fileConfig is the content of a JSON or TOML config file. Its keys are the names of the command
+// line flags, plus the command, parameters and overlap that are otherwise positional arguments.
+// Durations are strings in the format accepted by time.ParseDuration, such as "15s".
+type fileConfig struct {
+	Command       string   `json:"command"`
+	Parameters    []string `json:"parameters"`
+	Overlap       string   `json:"overlap"`
+	Placeholder   string   `json:"placeholder"`
+	Shell         bool     `json:"shell"`
+	Prefix        string   `json:"prefix"`
+	LogFormat     string   `json:"log-format"`
+	LogFile       string   `json:"log-file"`
+	LogMaxSize    string   `json:"log-max-size"`
+	LogKeep       int      `json:"log-keep"`
+	LogCompress   bool     `json:"log-compress"`
+	Env           []string `json:"env"`
+	Dir           string   `json:"dir"`
+	Releases      string   `json:"releases"`
+	Release       string   `json:"release"`
+	Instances     int      `json:"instances"`
+	Restart       string   `json:"restart"`
+	RestartDelay  string   `json:"restart-delay"`
+	RestartMax    string   `json:"restart-max-delay"`
+	RestartLimit  *int     `json:"restart-limit"`
+	RestartWindow string   `json:"restart-window"`
+	KillOrphans   bool     `json:"kill-orphans"`
+	StopSignal    string   `json:"stop-signal"`
+	StopTimeout   string   `json:"stop-timeout"`
+	RotateSignal  string   `json:"rotate-signal"`
+	Forward       []string `json:"forward"`
+	HTTPProbe     string   `json:"http-probe"`
+	TCPProbe      string   `json:"tcp-probe"`
+	ProbeTimeout  string   `json:"probe-timeout"`
+	ProbeInterval string   `json:"probe-interval"`
+	HTTPProxy     string   `json:"http-proxy"`
+	TCPProxy      string   `json:"tcp-proxy"`
+	Upstream      string   `json:"upstream"`
+	Listen        []string `json:"listen"`
+	Control       string   `json:"control"`
+	Metrics       string   `json:"metrics"`
+	Admin         string   `json:"admin"`
+}
+
+// loadConfig reads the config file at the given path, and returns the arguments it describes and
+// the keys it sets. The file is read as TOML if its extension is .toml, and as JSON otherwise.
+// Options missing from the file keep their default value. The arguments are only checked once the
+// command line has been applied on top of them, by parseArguments.
+func loadConfig(path string) (arguments, map[string]bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return arguments{}, nil, fmt.Errorf("Failed to read config file %q, error: %v", path, err)
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		if b, err = tomlToJSON(b); err != nil {
+			return arguments{}, nil, fmt.Errorf("Invalid config file %q: %v", path, err)
+		}
+	}
+	a, keys, err := parseConfig(b)
+	if err != nil {
+		return arguments{}, nil, fmt.Errorf("Invalid config file %q: %v", path, err)
+	}
+	return a, keys, nil
+}
+
+// parseConfig decodes the JSON config b, and converts its values to arguments. Errors point to the
+// offending key.
+func parseConfig(b []byte) (arguments, map[string]bool, error) {
+	var c fileConfig
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&c); err != nil {
+		return arguments{}, nil, describeJSONError(b, err)
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return arguments{}, nil, describeJSONError(b, err)
+	}
+	keys := map[string]bool{}
+	for k := range raw {
+		keys[k] = true
+	}
+
+	a := arguments{
+		command:     c.Command,
+		placeholder: placeholder,
+		params:      c.Parameters,
+		opts:        newOptions(),
+	}
+	if c.Placeholder != "" {
+		a.placeholder = c.Placeholder
+	}
+	a.opts.shell = c.Shell
+	prefix, err := parsePrefix(c.Prefix)
+	if err != nil {
+		return arguments{}, nil, fmt.Errorf("invalid prefix '%s' for key %s: %v", c.Prefix,
+			configKey("prefix"), err)
+	}
+	a.opts.prefix = prefix
+	if c.LogFormat != "" {
+		a.opts.logFormat = c.LogFormat
+	}
+	a.opts.logFile = c.LogFile
+	if c.LogMaxSize != "" {
+		size, err := parseSize(c.LogMaxSize)
+		if err != nil {
+			return arguments{}, nil, fmt.Errorf("invalid size '%s' for key %s", c.LogMaxSize,
+				configKey("log-max-size"))
+		}
+		a.opts.logMaxSize = size
+	}
+	a.opts.logKeep = c.LogKeep
+	a.opts.logCompress = c.LogCompress
+	a.opts.env = c.Env
+	a.opts.dir = c.Dir
+	a.opts.releases = c.Releases
+	a.opts.release = c.Release
+	if c.Instances != 0 {
+		a.opts.instances = c.Instances
+	}
+	if c.Restart != "" {
+		a.opts.restart = c.Restart
+	}
+	if c.RestartLimit != nil {
+		a.opts.restartLimit = *c.RestartLimit
+	}
+	a.opts.killOrphans = c.KillOrphans
+	signals := []struct {
+		key   string
+		value string
+		sig   *syscall.Signal
+	}{
+		{"stop-signal", c.StopSignal, &a.opts.stopSignal},
+		{"rotate-signal", c.RotateSignal, &a.opts.rotateSignal},
+	}
+	for _, s := range signals {
+		if s.value == "" {
+			continue
+		}
+		sig, err := parseSignal(s.value)
+		if err != nil {
+			return arguments{}, nil, fmt.Errorf("invalid signal '%s' for key %s", s.value,
+				configKey(s.key))
+		}
+		*s.sig = sig
+	}
+	for _, f := range c.Forward {
+		m, err := parseSignalMapping(f)
+		if err != nil {
+			return arguments{}, nil, fmt.Errorf("invalid signal '%s' for key %s", f,
+				configKey("forward"))
+		}
+		a.opts.forward = append(a.opts.forward, m)
+	}
+	a.opts.httpProbe = c.HTTPProbe
+	a.opts.tcpProbe = c.TCPProbe
+	a.opts.httpProxy = c.HTTPProxy
+	a.opts.tcpProxy = c.TCPProxy
+	a.opts.upstream = c.Upstream
+	a.opts.listen = c.Listen
+	a.opts.controlSocket = c.Control
+	a.opts.metrics = c.Metrics
+	a.opts.admin = c.Admin
+
+	durations := []struct {
+		key   string
+		value string
+		d     *time.Duration
+	}{
+		{"overlap", c.Overlap, &a.overlap},
+		{"restart-delay", c.RestartDelay, &a.opts.restartDelay},
+		{"restart-max-delay", c.RestartMax, &a.opts.restartMaxDelay},
+		{"restart-window", c.RestartWindow, &a.opts.restartWindow},
+		{"stop-timeout", c.StopTimeout, &a.opts.stopTimeout},
+		{"probe-timeout", c.ProbeTimeout, &a.opts.probeTimeout},
+		{"probe-interval", c.ProbeInterval, &a.opts.probeInterval},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v < 0 {
+			return arguments{}, nil, fmt.Errorf("invalid duration '%s' for key %s", d.value,
+				configKey(d.key))
+		}
+		*d.d = v
+	}
+
+	return a, keys, nil
+}
+
+func configKey(key string) string {
+	return fmt.Sprintf("%q", key)
+}
+
+// describeJSONError rewrites the errors returned by the JSON decoder to mention the offending key,
+// or the line of a syntax error.
+func describeJSONError(b []byte, err error) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		line := 1 + bytes.Count(b[:e.Offset], []byte("\n"))
+		return fmt.Errorf("syntax error on line %d: %v", line, e)
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("invalid value for key %s: expected %s, got %s", configKey(e.Field),
+			e.Type, e.Value)
+	}
+	if s := err.Error(); strings.HasPrefix(s, "json: unknown field ") {
+		return fmt.Errorf("unknown key %s", strings.TrimPrefix(s, "json: unknown field "))
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		iConfig string
+		oA      arguments
+		oErr    string
+	}{
+		{
+			`{"command": "cmd", "parameters": ["val0"], "overlap": "0"}`,
+			arguments{"cmd", "%alt", []string{"val0"}, 0, newOptions()}, "",
+		},
+		{
+			`{"command": "cmd {}", "placeholder": "{}", "parameters": ["val0", "val1"],
+			"overlap": "5s", "tcp-probe": "127.0.0.1:{}", "probe-interval": "100ms",
+			"tcp-proxy": ":5432", "upstream": "127.0.0.1:{}", "listen": [":80", ":443"]}`,
+			arguments{"cmd {}", "{}", []string{"val0", "val1"}, 5 * time.Second,
+				withOptions(func(o *options) {
+					o.tcpProbe = "127.0.0.1:{}"
+					o.probeInterval = 100 * time.Millisecond
+					o.tcpProxy = ":5432"
+					o.upstream = "127.0.0.1:{}"
+					o.listen = []string{":80", ":443"}
+				})}, "",
+		},
+		{
+			`{"command": "cmd", "parameters": ["val0"], "overlap": "0", "restart": "on-failure",
+			"restart-delay": "2s", "restart-limit": 0}`,
+			arguments{"cmd", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.restart = restartOnFailure
+				o.restartDelay = 2 * time.Second
+				o.restartLimit = 0
+			})}, "",
+		},
+		{
+			`{"command": "cmd", "parameters": ["val0"], "overlap": "0", "forward": ["HUP", "FOO"]}`,
+			arguments{}, `invalid signal 'FOO' for key "forward"`,
+		},
+		{
+			`{"command": "cmd", "parameters": ["val0"], "overlap": "0", "log-file": "cmd.log",
+				"log-max-size": "ten"}`,
+			arguments{}, `invalid size 'ten' for key "log-max-size"`,
+		},
+		{
+			// The command line may complete the config file, so it is only checked afterwards.
+			`{"parameters": ["val0"], "overlap": "0", "releases": "/srv/releases"}`,
+			arguments{"", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.releases = "/srv/releases"
+			})}, "",
+		},
+		{
+			`{"command": "cmd", "parameters": ["val0"], "overlap": "5"}`,
+			arguments{}, `invalid duration '5' for key "overlap"`,
+		},
+		{
+			`{"command": "cmd", "parameters": ["val0"], "overlap": "0", "probe-timeout": "-1s"}`,
+			arguments{}, `invalid duration '-1s' for key "probe-timeout"`,
+		},
+		{
+			`{"command": "cmd", "parameters": "val0", "overlap": "0"}`,
+			arguments{}, `invalid value for key "parameters": expected []string, got string`,
+		},
+		{
+			`{"command": "cmd", "parameters": ["val0"], "overlap": "0", "overlapp": "5s"}`,
+			arguments{}, `unknown key "overlapp"`,
+		},
+		{
+			"{\n\"command\": \"cmd\",\n\"parameters\": [\"val0\"]\n\"overlap\": \"0\"}",
+			arguments{}, "syntax error on line 4: invalid character '\"' after object key:value " +
+				"pair",
+		},
+	}
+
+	for i, test := range tests {
+		a, _, err := parseConfig([]byte(test.iConfig))
+		if !sameError(err, test.oErr) {
+			t.Errorf("For test #%d with config %s, expected err to be '%s', but was '%s'",
+				i, test.iConfig, test.oErr, err)
+		}
+		if !reflect.DeepEqual(test.oA, a) {
+			t.Errorf("For test #%d with config %s, expected a to be %+v, but was %+v",
+				i, test.iConfig, test.oA, a)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+// controlRequest is a command received on the control socket. The event loop handles it and sends
+// exactly one reply. written is closed once the reply has been written back to the client, so that
+// alternate does not exit before a "kill" or "stop" reply has left the process.
+type controlRequest struct {
+	command string
+	reply   chan controlReply
+	written chan struct{}
+}
+
+type controlReply struct {
+	ok      bool
+	message string
+}
+
+func newControlRequest(command string) controlRequest {
+	return controlRequest{command, make(chan controlReply, 1), make(chan struct{})}
+}
+
+// String returns the reply as sent on the control socket: "ok" or "error", followed by a space and
+// the message.
+func (r controlReply) String() string {
+	if r.ok {
+		return "ok " + r.message
+	}
+	return "error " + r.message
+}
+
+// exitingMessage is the reply to the requests that alternate cannot handle because it is exiting.
+const exitingMessage = "alternate is exiting"
+
+// controlCommand is a parsed control command line, such as "rotate -nowait -release v2".
+type controlCommand struct {
+	name string
+	// wait is false if the reply must be sent as soon as the rotation has started.
+	wait bool
+	// release is the release to rotate to, or empty to keep the current release.
+	release string
+}
+
+func parseControlCommand(line string) (controlCommand, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return controlCommand{}, errors.New("empty command")
+	}
+
+	c := controlCommand{name: fields[0], wait: true}
+	var nowait bool
+	f := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	switch c.name {
+	case "rotate":
+		f.BoolVar(&nowait, "nowait", false, "")
+		f.StringVar(&c.release, "release", "", "")
+	case "rollback":
+		f.BoolVar(&nowait, "nowait", false, "")
+	case "status", "stop", "kill":
+	default:
+		return controlCommand{}, fmt.Errorf("unknown command %q", line)
+	}
+
+	if err := f.Parse(fields[1:]); err != nil {
+		return controlCommand{}, fmt.Errorf("invalid command %q: %v", line, err)
+	}
+	if f.NArg() > 0 {
+		return controlCommand{}, fmt.Errorf("invalid command %q: unexpected arguments %q", line,
+			f.Args())
+	}
+	c.wait = !nowait
+	return c, nil
+}
+
+// listenControl listens on the Unix socket at the given path, removing any stale socket left by a
+// previous run. It is also used for the admin API.
+func listenControl(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if _, err := net.Dial("unix", path); err == nil {
+			return nil, fmt.Errorf("Socket %q is already in use", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// serveControl accepts connections on l until l is closed. Each connection sends a single command
+// line, which is forwarded on requests, and receives a single reply line. done must be closed when
+// requests stops being read.
+func serveControl(l net.Listener, requests chan controlRequest, done chan struct{}) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go handleControlConn(conn, requests, done)
+	}
+}
+
+func handleControlConn(conn net.Conn, requests chan controlRequest, done chan struct{}) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return
+	}
+
+	sendControlRequest(strings.TrimSpace(line), requests, done, func(r controlReply) {
+		fmt.Fprintln(conn, r)
+	})
+}
+
+// sendControlRequest forwards the command on requests, and writes the reply of the event loop with
+// write.
+func sendControlRequest(command string, requests chan controlRequest, done chan struct{},
+	write func(controlReply)) {
+
+	req := newControlRequest(command)
+	defer close(req.written)
+	reply := controlReply{false, exitingMessage}
+	select {
+	case requests <- req:
+		select {
+		case reply = <-req.reply:
+		case <-done:
+		}
+	case <-done:
+	}
+	write(reply)
+}
+
+// statusMessage describes the active and next commands, and the rotation in progress if any.
+func statusMessage(s *state) string {
+	var msg string
+	if active := s.active(); len(active) > 1 {
+		described := make([]string, len(active))
+		for i, p := range active {
+			described[i] = fmt.Sprintf("%q (%s)", p, describeCmd(s, p))
+		}
+		msg = "active parameters " + strings.Join(described, ", ")
+	} else {
+		currentParam, _ := s.current()
+		msg = fmt.Sprintf("current parameter %q (%s)", currentParam, describeCmd(s, currentParam))
+	}
+	nextParam, _ := s.next()
+	msg += fmt.Sprintf(", next parameter %q (%s)", nextParam, describeCmd(s, nextParam))
+	if s.release != "" {
+		msg += fmt.Sprintf(", current release %q", s.release)
+	}
+	if s.previousRelease != "" {
+		msg += fmt.Sprintf(", previous release %q", s.previousRelease)
+	}
+	if s.rotating() {
+		msg += fmt.Sprintf(", rotation to parameter %q in progress", s.transition.param)
+	}
+	return msg
+}
+
+// describeCmd describes the command with param: its pid, and how many times it was restarted.
+func describeCmd(s *state, param string) string {
+	desc := "not running"
+	if c := s.cmd(param); c != nil && c.Process != nil {
+		desc = fmt.Sprintf("pid %d", c.Process.Pid)
+	}
+	if n := s.restarts[param]; n > 0 {
+		desc += fmt.Sprintf(", %d restarts", n)
+	}
+	return desc
+}
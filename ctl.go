@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	ctlUsage = `Usage: alternate ctl -socket <path> <command>
+
+- socket: path of the control socket of the running alternate instance.
+- command: one of:
+  - rotate [--wait] [--release <id>]: start a rotation, from the given release if set. With --wait,
+    wait for the rotation to end, and exit with a non-zero code if it did not succeed.
+  - rollback [--wait]: start a rotation from the previous release.
+  - status: print the current and next parameters.
+  - stop: send the stop signal to all commands.
+  - kill: send a KILL signal to all commands, and exit alternate immediately.`
+
+	// Exit codes of alternate ctl.
+	ctlOK       = 0
+	ctlFailed   = 1
+	ctlBadUsage = 2
+)
+
+type ctlArguments struct {
+	socket  string
+	command string
+}
+
+// ctl sends a command to a running alternate instance through its control socket, prints the
+// reply to stdout, and returns the exit code.
+func ctl(osArgs []string, stdout, stderr io.Writer) int {
+	a, err := parseCtlArguments(osArgs)
+	if err != nil {
+		fmt.Fprintf(stderr, "%v\n\n%s\n", err, ctlUsage)
+		return ctlBadUsage
+	}
+
+	reply, err := sendCtlCommand(a.socket, a.command)
+	if err != nil {
+		fmt.Fprintf(stderr, "Failed to send command %q to control socket %q, error: %v\n",
+			a.command, a.socket, err)
+		return ctlFailed
+	}
+
+	fmt.Fprintln(stdout, reply)
+	if !strings.HasPrefix(reply, "ok ") {
+		return ctlFailed
+	}
+	return ctlOK
+}
+
+// parseCtlArguments parses the arguments following "alternate ctl", and returns the command to send
+// on the control socket.
+func parseCtlArguments(osArgs []string) (ctlArguments, error) {
+	var socket string
+	f := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	f.StringVar(&socket, "socket", "", "")
+	if err := f.Parse(osArgs); err != nil {
+		return ctlArguments{}, err
+	}
+
+	if socket == "" {
+		return ctlArguments{}, errors.New("Missing control socket")
+	}
+
+	args := f.Args()
+	if len(args) < 1 {
+		return ctlArguments{}, errors.New("Missing command")
+	}
+
+	switch args[0] {
+	case "rotate", "rollback":
+		var wait bool
+		var release string
+		rf := flag.NewFlagSet(args[0], flag.ContinueOnError)
+		rf.SetOutput(ioutil.Discard)
+		rf.BoolVar(&wait, "wait", false, "")
+		if args[0] == "rotate" {
+			rf.StringVar(&release, "release", "", "")
+		}
+		if err := rf.Parse(args[1:]); err != nil {
+			return ctlArguments{}, err
+		}
+		if rf.NArg() > 0 {
+			return ctlArguments{}, fmt.Errorf("Unexpected arguments: %q", rf.Args())
+		}
+		command := args[0]
+		if !wait {
+			command += " -nowait"
+		}
+		if release != "" {
+			command += " -release " + release
+		}
+		return ctlArguments{socket, command}, nil
+
+	case "status", "stop", "kill":
+		if len(args) > 1 {
+			return ctlArguments{}, fmt.Errorf("Unexpected arguments: %q", args[1:])
+		}
+		return ctlArguments{socket, args[0]}, nil
+	}
+
+	return ctlArguments{}, fmt.Errorf("Unknown command: '%s'", args[0])
+}
+
+// sendCtlCommand sends a command on the control socket at the given path, and returns the reply
+// line.
+func sendCtlCommand(socket, command string) (string, error) {
+	conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(reply, "\n"), nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseCtlArguments(t *testing.T) {
+	tests := []struct {
+		iOsArgs []string
+		oA      ctlArguments
+		oErr    string
+	}{
+		{
+			[]string{},
+			ctlArguments{}, "Missing control socket",
+		},
+		{
+			[]string{"-socket", "/run/alt.sock"},
+			ctlArguments{}, "Missing command",
+		},
+		{
+			[]string{"-socket", "/run/alt.sock", "restart"},
+			ctlArguments{}, "Unknown command: 'restart'",
+		},
+		{
+			[]string{"-socket", "/run/alt.sock", "status", "now"},
+			ctlArguments{}, `Unexpected arguments: ["now"]`,
+		},
+		{
+			[]string{"-socket", "/run/alt.sock", "rotate"},
+			ctlArguments{"/run/alt.sock", "rotate -nowait"}, "",
+		},
+		{
+			[]string{"-socket", "/run/alt.sock", "rotate", "--wait"},
+			ctlArguments{"/run/alt.sock", "rotate"}, "",
+		},
+		{
+			[]string{"-socket", "/run/alt.sock", "rotate", "--wait", "--release", "v2"},
+			ctlArguments{"/run/alt.sock", "rotate -release v2"}, "",
+		},
+		{
+			[]string{"-socket", "/run/alt.sock", "rollback"},
+			ctlArguments{"/run/alt.sock", "rollback -nowait"}, "",
+		},
+		{
+			[]string{"-socket", "/run/alt.sock", "rollback", "--release", "v2"},
+			ctlArguments{}, "flag provided but not defined: -release",
+		},
+		{
+			[]string{"-socket", "/run/alt.sock", "stop"},
+			ctlArguments{"/run/alt.sock", "stop"}, "",
+		},
+	}
+
+	for i, test := range tests {
+		a, err := parseCtlArguments(test.iOsArgs)
+		if !sameError(err, test.oErr) {
+			t.Errorf("For test #%d with osArgs %v, expected err to be '%s', but was '%s'",
+				i, test.iOsArgs, test.oErr, err)
+		}
+		if !reflect.DeepEqual(test.oA, a) {
+			t.Errorf("For test #%d with osArgs %v, expected a to be %+v, but was %+v",
+				i, test.iOsArgs, test.oA, a)
+		}
+	}
+}
+
+func TestCtl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "control.sock")
+
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Fake control socket that replies to rotate commands with a rollback.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			command, _ := bufio.NewReader(conn).ReadString('\n')
+			if strings.HasPrefix(command, "rotate") {
+				fmt.Fprintln(conn, `error Rotation to parameter "param1" rolled back`)
+			} else {
+				fmt.Fprintln(conn, "ok "+command)
+			}
+			conn.Close()
+		}
+	}()
+
+	tests := []struct {
+		iOsArgs []string
+		oCode   int
+		oStdout string
+	}{
+		{
+			[]string{"-socket", socket, "status"},
+			ctlOK, "ok status\n",
+		},
+		{
+			[]string{"-socket", socket, "rotate", "--wait"},
+			ctlFailed, "error Rotation to parameter \"param1\" rolled back\n",
+		},
+		{
+			[]string{"-socket", path.Join(dir, "missing.sock"), "status"},
+			ctlFailed, "",
+		},
+		{
+			[]string{"status"},
+			ctlBadUsage, "",
+		},
+	}
+
+	for i, test := range tests {
+		stdout := &bytes.Buffer{}
+		code := ctl(test.iOsArgs, stdout, newNilWriter())
+		if code != test.oCode {
+			t.Errorf("For test #%d with osArgs %v, expected code to be %d, but was %d",
+				i, test.iOsArgs, test.oCode, code)
+		}
+		if stdout.String() != test.oStdout {
+			t.Errorf("For test #%d with osArgs %v, expected stdout to be %q, but was %q",
+				i, test.iOsArgs, test.oStdout, stdout.String())
+		}
+	}
+}
+
+// TestCtlKillProcess sends kill commands to a real alternate process, which calls os.Exit as soon
+// as alternate returns, to check that the reply is written before the process exits.
+func TestCtlKillProcess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bin := path.Join(dir, "alternate")
+	b := exec.Command("go", "build", "-o", bin, reflect.TypeOf(options{}).PkgPath())
+	if out, err := b.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to build alternate, error: %v, output: %s", err, out)
+	}
+
+	socket := path.Join(dir, "control.sock")
+	for i := 0; i < 10; i++ {
+		c := exec.Command(bin, "-control", socket, "sleep 10", "val0", "0")
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		for start := time.Now(); time.Since(start) < 5*time.Second; {
+			if _, err := os.Stat(socket); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		stdout := &bytes.Buffer{}
+		if code := ctl([]string{"-socket", socket, "kill"}, stdout, newNilWriter()); code != ctlOK {
+			t.Errorf("For run #%d, expected code to be %d, but was %d with stdout %q", i, ctlOK,
+				code, stdout.String())
+		}
+		c.Wait()
+		ws := c.ProcessState.Sys().(syscall.WaitStatus)
+		if ws.ExitStatus() != exitKilled {
+			t.Errorf("For run #%d, expected alternate to exit with %d, but was %v", i,
+				exitKilled, c.ProcessState)
+		}
+	}
+}
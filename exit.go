@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// exitEvent is sent when the command run with param exits. err is the error returned by Wait,
+// state the state of the exited process, and duration how long the command ran.
+type exitEvent struct {
+	param    string
+	err      error
+	state    *os.ProcessState
+	duration time.Duration
+}
+
+// String returns the exit status, such as "exit status 1" or "signal: killed".
+func (e exitEvent) String() string {
+	if e.state != nil {
+		return e.state.String()
+	}
+	if e.err == nil {
+		return "exit status 0"
+	}
+	return e.err.Error()
+}
+
+// code returns the exit code of the command, or -1 if it was terminated by a signal or did not
+// exit normally.
+func (e exitEvent) code() int {
+	if e.state == nil {
+		return -1
+	}
+	return e.state.ExitCode()
+}
+
+// signal returns the signal that terminated the command, or 0 if it exited normally.
+func (e exitEvent) signal() syscall.Signal {
+	if e.state == nil {
+		return 0
+	}
+	if ws, ok := e.state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ws.Signal()
+	}
+	return 0
+}
+
+// usage describes how long the command ran, and the resources it used.
+func (e exitEvent) usage() string {
+	s := fmt.Sprintf("ran for %v", e.duration.Round(time.Millisecond))
+	if e.state == nil {
+		return s
+	}
+	s += fmt.Sprintf(", user time %v, system time %v", e.state.UserTime(), e.state.SystemTime())
+	if ru, ok := e.state.SysUsage().(*syscall.Rusage); ok {
+		// Maxrss is in kilobytes on Linux.
+		s += fmt.Sprintf(", max RSS %d KB", ru.Maxrss)
+	}
+	return s
+}
+
+// exitCode returns the exit code that a shell would report for the command: its exit code, or 128
+// plus the signal number if it was terminated by a signal.
+func (e exitEvent) exitCode() int {
+	if sig := e.signal(); sig != 0 {
+		return 128 + int(sig)
+	}
+	if c := e.code(); c >= 0 {
+		return c
+	}
+	return 1
+}
+
+// fields returns the exit status and resource usage of the command as log event fields.
+func (e exitEvent) fields() fields {
+	f := fields{
+		"param":       e.param,
+		"exit_code":   e.code(),
+		"duration_ms": milliseconds(e.duration),
+	}
+	if e.state != nil {
+		f["pid"] = e.state.Pid()
+		f["user_time_ms"] = milliseconds(e.state.UserTime())
+		f["system_time_ms"] = milliseconds(e.state.SystemTime())
+		if ru, ok := e.state.SysUsage().(*syscall.Rusage); ok {
+			f["max_rss_kb"] = ru.Maxrss
+		}
+	}
+	if sig := e.signal(); sig != 0 {
+		f["signal"] = signalName(sig)
+	}
+	if e.err != nil && e.state == nil {
+		f["error"] = e.err
+	}
+	return f
+}
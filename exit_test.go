@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExitEvent(t *testing.T) {
+	tests := []struct {
+		iCommand string
+		oString  string
+		oCode    int
+		oSignal  syscall.Signal
+	}{
+		{"exit 0", "exit status 0", 0, 0},
+		{"exit 3", "exit status 3", 3, 0},
+		{"kill -KILL $$", "signal: killed", -1, syscall.SIGKILL},
+	}
+
+	for i, test := range tests {
+		c, err := cmd(test.iCommand, true, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exit := make(chan exitEvent, 1)
+		if err := runCmd(c, "param0", exit); err != nil {
+			t.Fatal(err)
+		}
+
+		var e exitEvent
+		select {
+		case e = <-exit:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("For test #%d with command %q, command did not exit", i, test.iCommand)
+		}
+
+		if e.param != "param0" || e.String() != test.oString || e.code() != test.oCode ||
+			e.signal() != test.oSignal {
+			t.Errorf("For test #%d with command %q, expected exit event %q with code %d and "+
+				"signal %d, but was %q with %q, %d and %d", i, test.iCommand, test.oString,
+				test.oCode, test.oSignal, e.param, e, e.code(), e.signal())
+		}
+		if u := e.usage(); !strings.HasPrefix(u, "ran for ") || !strings.Contains(u, "max RSS ") {
+			t.Errorf("For test #%d with command %q, unexpected usage %q", i, test.iCommand, u)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+)
+
+// listenFiles opens a TCP listener on each address, and returns the files of the listening sockets,
+// to be inherited by the commands. The listeners themselves are closed: alternate never accepts
+// connections on them.
+func listenFiles(addresses []string) ([]*os.File, error) {
+	var files []*os.File
+	for _, a := range addresses {
+		l, err := net.Listen("tcp", a)
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		f, err := l.(*net.TCPListener).File()
+		l.Close()
+		if err != nil {
+			closeFiles(files)
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// inheritFiles passes files to c using the systemd socket activation protocol: the files become
+// file descriptors 3 and up, LISTEN_FDS is set to their count, and LISTEN_PID is set to the pid of
+// the command. Since the pid is only known once the command has started, the command is wrapped in
+// a shell that exports its own pid before replacing itself with the command.
+func inheritFiles(c *exec.Cmd, files []*os.File) {
+	if len(files) == 0 {
+		return
+	}
+
+	c.ExtraFiles = files
+	if c.Env == nil {
+		c.Env = os.Environ()
+	}
+	c.Env = append(c.Env, fmt.Sprintf("LISTEN_FDS=%d", len(files)))
+
+	// If the command cannot be found, keep it unwrapped so that starting it fails right away.
+	p, err := exec.LookPath(c.Path)
+	if err != nil {
+		return
+	}
+	sh, err := exec.LookPath("/bin/sh")
+	if err != nil {
+		return
+	}
+	args := append([]string{sh, "-c", `export LISTEN_PID=$$; exec "$0" "$@"`, p}, c.Args[1:]...)
+	c.Path = sh
+	c.Args = args
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// startPlaceholder is replaced in the log file template by the time the command was started.
+const startPlaceholder = "%{start}"
+
+// startFormat is the format of the start time in the log file names, such as 20150601T120000Z.
+const startFormat = "20060102T150405Z"
+
+// expandStart returns s with every occurrence of the start placeholder replaced by t.
+func expandStart(s string, t time.Time) string {
+	return strings.Replace(s, startPlaceholder, t.UTC().Format(startFormat), -1)
+}
+
+// logFiles tracks the open log files of the commands, so that they can all be reopened at once.
+// Commands whose log file has the same path share a single logFile, so that they do not rotate it
+// from under each other.
+type logFiles struct {
+	mutex sync.Mutex
+	log   *logger
+	files map[string]*logFile
+	// maxSize is the size in bytes after which a log file is rotated, or 0 to never rotate.
+	maxSize int64
+	// keep is the number of rotated files to keep, or 0 to keep them all.
+	keep int
+	// compress is true if the rotated files are compressed with gzip.
+	compress bool
+}
+
+func newLogFiles(l *logger, maxSize int64, keep int, compress bool) *logFiles {
+	return &logFiles{log: l, files: map[string]*logFile{}, maxSize: maxSize, keep: keep,
+		compress: compress}
+}
+
+// open opens the log file at path for appending, creating it if needed, or returns the log file
+// already open at path. Each call to open must be matched by a call to Close.
+func (s *logFiles) open(path string) (*logFile, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if f, ok := s.files[path]; ok {
+		f.refs++
+		return f, nil
+	}
+	f := &logFile{set: s, path: path, refs: 1}
+	if err := f.reopen(); err != nil {
+		return nil, err
+	}
+	s.files[path] = f
+	return f, nil
+}
+
+// reopen closes and reopens every open log file, for example after they were moved by logrotate.
+func (s *logFiles) reopen() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, f := range s.files {
+		if err := f.reopen(); err != nil {
+			s.log.errorf(err, "Failed to reopen log file %q, error: %v\n", f.path, err)
+		}
+	}
+}
+
+// logFile writes to the file at path, and rotates it when it would grow past the maximum size.
+// The rotated files are named path.1, path.2 and so on from the newest to the oldest, with a .gz
+// extension if they are compressed. A logFile is safe for concurrent use.
+type logFile struct {
+	mutex sync.Mutex
+	set   *logFiles
+	path  string
+	// refs is the number of commands writing to the file. It is guarded by set.mutex.
+	refs int
+	file *os.File
+	size int64
+	// compressed is closed once the compression of the last rotated file has ended, or nil if no
+	// compression was started.
+	compressed chan struct{}
+}
+
+var errLogFileClosed = errors.New("log file closed")
+
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, errLogFileClosed
+	}
+	if max := f.set.maxSize; max > 0 && f.size > 0 && f.size+int64(len(p)) > max {
+		if err := f.rotate(); err != nil {
+			f.set.log.errorf(err, "Failed to rotate log file %q, error: %v\n", f.path, err)
+		}
+		if f.file == nil {
+			return 0, errLogFileClosed
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the file once every command writing to it has closed it, after waiting for the
+// compression of the last rotated file if any. Closing a closed logFile does nothing.
+func (f *logFile) Close() error {
+	s := f.set
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if f.refs == 0 {
+		return nil
+	}
+	f.refs--
+	if f.refs > 0 {
+		return nil
+	}
+	delete(s.files, f.path)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.waitCompressed()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// waitCompressed waits for the compression of the last rotated file to end. f.mutex must be held.
+func (f *logFile) waitCompressed() {
+	if f.compressed != nil {
+		<-f.compressed
+		f.compressed = nil
+	}
+}
+
+func (f *logFile) reopen() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.open()
+}
+
+// open closes the file if it is open, then opens it again. f.mutex must be held.
+func (f *logFile) open() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, fi.Size()
+	return nil
+}
+
+// rotate renames the file to path.1 after shifting the previous rotated files, removes the rotated
+// files beyond the retention count, and opens a new file. The new file is opened even if rotating
+// failed. If needed, path.1 is compressed in the background, so that writes are not held up in the
+// meantime. f.mutex must be held.
+func (f *logFile) rotate() error {
+	err := f.shift()
+	if openErr := f.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (f *logFile) shift() error {
+	// path.1 cannot be renamed while it is being compressed.
+	f.waitCompressed()
+	n := 0
+	for f.rotated(n+1) != "" {
+		n++
+	}
+	keep := f.set.keep
+	for i := n; i >= 1; i-- {
+		p := f.rotated(i)
+		if keep > 0 && i >= keep {
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+			continue
+		}
+		next := fmt.Sprintf("%s.%d%s", f.path, i+1, strings.TrimPrefix(p, f.rotatedName(i)))
+		if err := os.Rename(p, next); err != nil {
+			return err
+		}
+	}
+
+	first := f.rotatedName(1)
+	if err := os.Rename(f.path, first); err != nil {
+		return err
+	}
+	if f.set.compress {
+		compressed := make(chan struct{})
+		f.compressed = compressed
+		go func() {
+			defer close(compressed)
+			if err := gzipFile(first); err != nil {
+				f.set.log.errorf(err, "Failed to compress log file %q, error: %v\n", first, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// rotatedName returns the name of the rotated file with index i before compression.
+func (f *logFile) rotatedName(i int) string {
+	return f.path + "." + strconv.Itoa(i)
+}
+
+// rotated returns the name of the existing rotated file with index i, compressed or not, or an
+// empty string if there is none.
+func (f *logFile) rotated(i int) string {
+	for _, p := range []string{f.rotatedName(i), f.rotatedName(i) + ".gz"} {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// gzipFile compresses the file at path to path.gz, then removes it.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// parseSize parses a size in bytes, optionally followed by the unit K, M or G, such as "10M".
+func parseSize(s string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30}
+	n, unit := s, int64(1)
+	if len(s) > 0 {
+		if u, ok := units[strings.ToUpper(s[len(s)-1:])]; ok {
+			n, unit = s[:len(s)-1], u
+		}
+	}
+	v, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return v * unit, nil
+}
+
+// sizeValue is a flag value that parses a size with parseSize.
+type sizeValue int64
+
+func (v *sizeValue) String() string {
+	return strconv.FormatInt(int64(*v), 10)
+}
+
+func (v *sizeValue) Set(s string) error {
+	n, err := parseSize(s)
+	if err != nil {
+		return err
+	}
+	*v = sizeValue(n)
+	return nil
+}
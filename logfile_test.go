@@ -0,0 +1,208 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestExpandStart(t *testing.T) {
+	start := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	expected := "/var/log/app-20150601T120000Z.log"
+	if s := expandStart("/var/log/app-%{start}.log", start); s != expected {
+		t.Errorf("Expected %s, but was %s", expected, s)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		iS    string
+		oSize int64
+		oErr  string
+	}{
+		{"0", 0, ""},
+		{"100", 100, ""},
+		{"10K", 10 << 10, ""},
+		{"10m", 10 << 20, ""},
+		{"1G", 1 << 30, ""},
+		{"", 0, `invalid size ""`},
+		{"M", 0, `invalid size "M"`},
+		{"-1K", 0, `invalid size "-1K"`},
+		{"10MB", 0, `invalid size "10MB"`},
+	}
+
+	for i, test := range tests {
+		size, err := parseSize(test.iS)
+		if !sameError(err, test.oErr) {
+			t.Errorf("For test #%d with s %q, expected error %q, but was %v", i, test.iS,
+				test.oErr, err)
+		}
+		if size != test.oSize {
+			t.Errorf("For test #%d with s %q, expected size %d, but was %d", i, test.iS,
+				test.oSize, size)
+		}
+	}
+}
+
+func TestLogFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "cmd.log")
+
+	s := newLogFiles(newLogger(ioutil.Discard, logFormatText), 10, 2, false)
+	f, err := s.open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"line1\n", "line2\n", "line3\n", "line4\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	// Each line is rotated out by the next one, and only the 2 newest rotated files are kept.
+	expected := map[string]string{
+		p:           "line4\n",
+		p + ".1":    "line3\n",
+		p + ".2":    "line2\n",
+		p + ".3":    "",
+		p + ".1.gz": "",
+	}
+	for name, content := range expected {
+		b, err := ioutil.ReadFile(name)
+		if content == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("Expected %s to not exist, but got error %v", name, err)
+			}
+			continue
+		}
+		if string(b) != content {
+			t.Errorf("Expected %s to contain %q, but was %q (error %v)", name, content, b, err)
+		}
+	}
+}
+
+func TestLogFileCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "cmd.log")
+
+	s := newLogFiles(newLogger(ioutil.Discard, logFormatText), 10, 0, true)
+	f, err := s.open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("line1\n"))
+	f.Write([]byte("line2\n"))
+	f.Write([]byte("line3\n"))
+	f.Close()
+
+	for name, content := range map[string]string{p + ".1.gz": "line2\n", p + ".2.gz": "line1\n"} {
+		gz, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(zr)
+		gz.Close()
+		if string(b) != content {
+			t.Errorf("Expected %s to contain %q, but was %q (error %v)", name, content, b, err)
+		}
+	}
+	if _, err := os.Stat(p + ".1"); !os.IsNotExist(err) {
+		t.Errorf("Expected %s.1 to be removed after compression, but got error %v", p, err)
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "cmd.log")
+
+	s := newLogFiles(newLogger(ioutil.Discard, logFormatText), 0, 0, false)
+	f, err := s.open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("before\n"))
+
+	// Move the file away like logrotate does, then reopen.
+	if err := os.Rename(p, p+".old"); err != nil {
+		t.Fatal(err)
+	}
+	s.reopen()
+	f.Write([]byte("after\n"))
+	f.Close()
+
+	// Closed files are not reopened anymore.
+	s.reopen()
+	if _, err := f.Write([]byte("closed\n")); err != errLogFileClosed {
+		t.Errorf("Expected error %v after Close, but was %v", errLogFileClosed, err)
+	}
+
+	for name, content := range map[string]string{p + ".old": "before\n", p: "after\n"} {
+		b, err := ioutil.ReadFile(name)
+		if string(b) != content {
+			t.Errorf("Expected %s to contain %q, but was %q (error %v)", name, content, b, err)
+		}
+	}
+}
+
+func TestLogFileShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alternate_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "cmd.log")
+
+	// Two commands writing to the same path share the file, and its rotations.
+	s := newLogFiles(newLogger(ioutil.Discard, logFormatText), 10, 0, false)
+	f0, err := s.open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f1, err := s.open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f0 != f1 {
+		t.Fatal("Expected both commands to share the same log file")
+	}
+	f0.Write([]byte("line0\n"))
+	f1.Write([]byte("line1\n"))
+
+	// The file stays open until both commands have closed it.
+	f0.Close()
+	if _, err := f1.Write([]byte("line2\n")); err != nil {
+		t.Errorf("Expected the log file to be still open, but got error %v", err)
+	}
+	f1.Close()
+	if _, err := f1.Write([]byte("line3\n")); err != errLogFileClosed {
+		t.Errorf("Expected error %v after the last Close, but was %v", errLogFileClosed, err)
+	}
+
+	for name, content := range map[string]string{p + ".2": "line0\n", p + ".1": "line1\n",
+		p: "line2\n"} {
+		b, err := ioutil.ReadFile(name)
+		if string(b) != content {
+			t.Errorf("Expected %s to contain %q, but was %q (error %v)", name, content, b, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Formats of the alternate logs.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// fields are the structured fields of a log event, such as "param" or "pid".
+type fields map[string]interface{}
+
+// logger writes the events of alternate to w, one per line: in the text format, as the message of
+// the event preceded by "alternate | ", and in the JSON format, as an object holding the time, type
+// and message of the event along with its fields. A logger is safe for concurrent use.
+type logger struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	format string
+	// now returns the time of the events. It can be replaced in tests.
+	now func() time.Time
+}
+
+func newLogger(w io.Writer, format string) *logger {
+	return &logger{w: w, format: format, now: time.Now}
+}
+
+// event logs an event of the given type, with the given fields and a message formatted according
+// to format.
+func (l *logger) event(typ string, f fields, format string, a ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintf(format, a...), "\n")
+
+	var line []byte
+	if l.format == logFormatJSON {
+		o := make(map[string]interface{}, len(f)+3)
+		for k, v := range f {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			o[k] = v
+		}
+		o["time"] = l.now().UTC().Format(time.RFC3339Nano)
+		o["type"] = typ
+		o["msg"] = msg
+		b, err := json.Marshal(o)
+		if err != nil {
+			b = []byte(fmt.Sprintf(`{"type":"log_error","msg":%q}`, err.Error()))
+		}
+		line = b
+	} else {
+		line = []byte("alternate | " + msg)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.w.Write(append(line, '\n'))
+}
+
+// printf logs an informational event without fields.
+func (l *logger) printf(format string, a ...interface{}) {
+	l.event("info", nil, format, a...)
+}
+
+// errorf logs an error event, with the error in the "error" field.
+func (l *logger) errorf(err error, format string, a ...interface{}) {
+	l.event("error", fields{"error": err}, format, a...)
+}
+
+// milliseconds returns d as a number of milliseconds, for the duration fields of the JSON events.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
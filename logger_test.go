@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	now := func() time.Time { return time.Date(2015, 6, 1, 12, 0, 0, 5e6, time.UTC) }
+	tests := []struct {
+		iFormat string
+		iType   string
+		iFields fields
+		iMsg    string
+		oLine   string
+	}{
+		{logFormatText, "info", nil, "Starting\n", "alternate | Starting\n"},
+		{logFormatText, "cmd_start", fields{"param": "3000", "pid": 42}, "Running",
+			"alternate | Running\n"},
+		{logFormatJSON, "info", nil, "Starting\n",
+			`{"msg":"Starting","time":"2015-06-01T12:00:00.005Z","type":"info"}` + "\n"},
+		{logFormatJSON, "cmd_start", fields{"param": "3000", "pid": 42}, "Running",
+			`{"msg":"Running","param":"3000","pid":42,"time":"2015-06-01T12:00:00.005Z",` +
+				`"type":"cmd_start"}` + "\n"},
+		{logFormatJSON, "error", fields{"error": errors.New("boom")}, "Failed",
+			`{"error":"boom","msg":"Failed","time":"2015-06-01T12:00:00.005Z","type":"error"}` +
+				"\n"},
+	}
+
+	for i, test := range tests {
+		var b bytes.Buffer
+		l := newLogger(&b, test.iFormat)
+		l.now = now
+		l.event(test.iType, test.iFields, "%s", test.iMsg)
+		if line := b.String(); line != test.oLine {
+			t.Errorf("For test #%d, expected line to be %q, but was %q", i, test.oLine, line)
+		}
+	}
+}
+
+func TestExitEventFields(t *testing.T) {
+	e := exitEvent{"3000", errors.New("exec: not started"), nil, 1500 * time.Millisecond}
+	var o map[string]interface{}
+	var b bytes.Buffer
+	newLogger(&b, logFormatJSON).event("cmd_exit", e.fields(), "")
+	if err := json.Unmarshal(b.Bytes(), &o); err != nil {
+		t.Fatalf("Expected a JSON object, but got error: %v", err)
+	}
+	delete(o, "time")
+	expected := map[string]interface{}{
+		"type":        "cmd_exit",
+		"msg":         "",
+		"param":       "3000",
+		"exit_code":   -1.0,
+		"duration_ms": 1500.0,
+		"error":       "exec: not started",
+	}
+	if !reflect.DeepEqual(o, expected) {
+		t.Errorf("Expected fields to be %v, but was %v", expected, o)
+	}
+}
@@ -2,55 +2,382 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"syscall"
 	"time"
 )
 
 const (
 	placeholder = "%alt"
-	usage       = `Usage: alternate <command> <parameters...> <overlap>
+	usage       = `Usage: alternate [options] <command> <parameters...> <overlap>
+       alternate -config <path> [options] [<command> <parameters...> <overlap>]
+       alternate ctl -socket <path> <command>
 
-- command: command to run, with the substring ` + placeholder + ` used a a placeholder for the rotated parameters.
-- parameters: space-separated list of parameters to rotate through after receiving a USR1 signal.
-- overlap: delay between starting the next command and sending a TERM signal to the previous command.
+- command: command to run, with every occurrence of the substring ` + placeholder + ` used as a placeholder for the
+  rotated parameters, and every occurrence of %{name} used as a placeholder for the named value "name" of
+  the rotated parameters. The command is split into words with shell quoting rules, e.g. '--name "my app"' is two words.
+- parameters: space-separated list of parameters to rotate through after receiving a USR1 signal. A
+  parameter can also be a comma-separated list of named values, such as port=3000,admin=9000.
+- overlap: delay between starting the next command (or the next command becoming ready, if a probe is
+  set) and sending a TERM signal to the previous command.
+
+Options:
+- -config <path>: JSON config file, or TOML if its name ends with .toml, to read the command, parameters,
+  overlap and options from. Its keys are the option names without the leading dash, plus "command",
+  "parameters" and "overlap". Options and arguments given on the command line take precedence over the
+  config file, and can complete it. YAML is not supported.
+- -placeholder <string>: placeholder for the rotated parameters (default ` + placeholder + `).
+- -shell: run the command through /bin/sh -c, to use shell features such as variables, pipes or redirections.
+- -prefix <fields>: comma-separated list of fields among time, param and pid to write before each line
+  of output of the commands. Example: -prefix time,param.
+- -log-format <format>: format of the alternate logs written to stderr: text, or json for one JSON object
+  per line with the time, type, message and fields of each event (default text).
+- -log-file <path>: file to write the output of each command to instead of stdout and stderr, with the
+  placeholders expanded for the parameter, and %{start} replaced by the start time of the command. The
+  log files are reopened on HUP signal. Example: -log-file /var/log/myserver-` + placeholder + `.log.
+- -log-max-size <size>: size after which a log file is rotated to <path>.1, such as 10M (default 0,
+  never rotate).
+- -log-keep <n>: number of rotated log files to keep (default 0, keep all).
+- -log-compress: compress the rotated log files with gzip.
+- -env <key=value>: environment variable, with the placeholders expanded for the parameter, to add to the
+  environment of the command. Can be repeated. Example: -env PORT=` + placeholder + `.
+- -dir <path>: working directory, with the placeholders expanded for the parameter, of the command.
+- -releases <path>: directory containing one subdirectory per release. Commands are run from the directory
+  of a release, which also replaces the placeholder ` + releasePlaceholder + `.
+- -release <id>: release to run the first command from, required with -releases.
+- -instances <n>: number of commands to run concurrently, each with its own parameter (default 1). Each
+  rotation replaces them one at a time, and halts if a replacement is rolled back. Requires more
+  parameters than instances.
+- -restart <policy>: restart policy of the active commands that exit: never, on-failure (exit with a
+  non-zero status or a signal) or always (default never).
+- -restart-delay <duration>: delay before restarting a command, doubled for each restart of the same
+  command within the restart window (default 1s).
+- -restart-max-delay <duration>: maximum delay before restarting a command (default 30s).
+- -restart-limit <n>: maximum number of restarts of a command within the restart window, after which
+  it is not restarted anymore, or 0 for no limit (default 5).
+- -restart-window <duration>: window over which restarts are counted (default 1m).
+- -kill-orphans: send a KILL signal to the commands when alternate exits, even if alternate is killed
+  (Linux only).
+- -stop-signal <signal>: signal sent to the commands to stop them, such as QUIT (default TERM).
+- -stop-timeout <duration>: delay after which a command that is still running after the stop signal is
+  sent a KILL signal, along with its process group, or 0 to wait forever (default 0).
+- -rotate-signal <signal>: signal that starts a rotation when received by alternate (default USR1).
+- -forward <signal[:signal]>: signal to forward to the active commands when received by alternate,
+  optionally as another signal. Can be repeated. Example: -forward HUP or -forward HUP:USR2.
+- -http-probe <url>: URL, with ` + placeholder + ` replaced by the next parameter, that must return a 2xx
+  status code before the previous command is terminated.
+- -tcp-probe <address>: address, with ` + placeholder + ` replaced by the next parameter, that must accept a
+  TCP connection before the previous command is terminated.
+- -probe-timeout <duration>: delay after which the rotation is aborted and the next command is terminated
+  if it is still not ready (default 30s).
+- -probe-interval <duration>: delay between two probe attempts (default 1s). Each attempt may take
+  until -probe-timeout.
+- -http-proxy <address>: address to listen on for HTTP requests, which are forwarded to the upstream of the
+  current command.
+- -tcp-proxy <address>: address to listen on for TCP connections, which are forwarded to the upstream of
+  the current command.
+- -upstream <address>: address, with ` + placeholder + ` replaced by the current parameter, that the proxies
+  forward to.
+- -listen <address>: address to open a listening TCP socket on, passed to every command as file descriptor
+  3 and up with LISTEN_FDS and LISTEN_PID set (systemd socket activation). Can be repeated.
+- -control <path>: path of a Unix socket to listen on for control commands (rotate, rollback,
+  status, stop, kill).
+- -metrics <address>: address to listen on for HTTP requests to /metrics, which returns metrics about the
+  rotations and the commands in the Prometheus text format. Example: -metrics 127.0.0.1:9100.
+- -admin <address>: loopback address, such as 127.0.0.1:9101, or path of a Unix socket to listen on for
+  requests to the HTTP admin API: GET /status, POST /rotate[?release=<id>&wait=false] and POST /stop.
 
 Example: alternate "/home/me/myserver 127.0.0.1:%alt" 3000 3001 15s
+Example: alternate "/home/me/myserver -port %{port} -admin-port %{admin}" port=3000,admin=9000 \
+         port=3001,admin=9001 15s
+
+alternate exits with 0 after a TERM or INT signal, with the exit code of the last active command if it
+exited on its own, or with 125 if it could not start.
+
+Run "alternate ctl" for the usage of the control client.
 
 See https://github.com/peferron/alternate for more information.`
 )
 
 type arguments struct {
-	command string
-	params  []string
-	overlap time.Duration
+	command     string
+	placeholder string
+	params      []string
+	overlap     time.Duration
+	opts        options
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(ctl(os.Args[2:], os.Stdout, os.Stderr))
+	}
+
 	a, err := parseArguments(os.Args)
 	if err != nil {
 		fmt.Printf("%v\n\n%s\n", err, usage)
 		os.Exit(1)
 	}
 
-	alternate(a.command, placeholder, a.params, a.overlap, os.Stderr, os.Stdout, os.Stderr)
+	os.Exit(alternate(a.command, a.placeholder, a.params, a.overlap, a.opts, os.Stderr,
+		os.Stdout, os.Stderr))
 }
 
 func parseArguments(osArgs []string) (arguments, error) {
-	l := len(osArgs)
-
-	if l < 4 {
+	if len(osArgs) < 1 {
 		return arguments{}, errors.New("Not enough arguments")
 	}
 
-	command := osArgs[1]
-	params := osArgs[2 : l-1]
-	overlapStr := osArgs[l-1]
+	// Parse the flags a first time only to find the config file, then a second time on top of
+	// the config file, so that flags take precedence over it.
+	var configPath string
+	if err := newFlagSet(osArgs[0], &arguments{}, &configPath).Parse(osArgs[1:]); err != nil {
+		return arguments{}, err
+	}
+
+	a := arguments{placeholder: placeholder, opts: newOptions()}
+	var keys map[string]bool
+	if configPath != "" {
+		var err error
+		if a, keys, err = loadConfig(configPath); err != nil {
+			return arguments{}, err
+		}
+	}
+
+	f := newFlagSet(osArgs[0], &a, &configPath)
+	f.Parse(osArgs[1:])
+
+	// Refer to the options that were only set by the config file by their config key, and to the
+	// others by their flag.
+	flags := map[string]bool{}
+	f.Visit(func(fl *flag.Flag) {
+		flags[fl.Name] = true
+	})
+	name := func(key string) string {
+		if keys[key] && !flags[key] {
+			return configKey(key)
+		}
+		return flagName(key)
+	}
+	if err := checkArguments(a, name); err != nil {
+		return arguments{}, err
+	}
+
+	args := f.Args()
+	l := len(args)
+
+	if l > 0 || configPath == "" {
+		if l < 3 {
+			return arguments{}, errors.New("Not enough arguments")
+		}
+
+		a.command = args[0]
+		a.params = args[1 : l-1]
+		overlapStr := args[l-1]
+
+		overlap, err := time.ParseDuration(overlapStr)
+		if err != nil || overlap < 0 {
+			return arguments{}, fmt.Errorf("Invalid overlap: '%s'", overlapStr)
+		}
+		a.overlap = overlap
+	} else {
+		// Without positional arguments, the config file must provide them.
+		missing := ""
+		switch {
+		case a.command == "":
+			missing = "command"
+		case len(a.params) == 0:
+			missing = "parameters"
+		case !keys["overlap"]:
+			missing = "overlap"
+		}
+		if missing != "" {
+			return arguments{}, fmt.Errorf("Invalid config file %q: missing key %s", configPath,
+				configKey(missing))
+		}
+	}
+
+	if a.opts.instances > 1 && len(a.params) <= a.opts.instances {
+		return arguments{}, fmt.Errorf("Not enough parameters for %d instances: %q",
+			a.opts.instances, a.params)
+	}
+
+	templates := append([]string{a.command, a.opts.dir, a.opts.httpProbe, a.opts.tcpProbe,
+		a.opts.upstream, strings.Replace(a.opts.logFile, startPlaceholder, "", -1)}, a.opts.env...)
+	for _, s := range templates {
+		if a.opts.releases != "" {
+			s = expandRelease(s, "")
+		}
+		if err := checkNamedPlaceholders(s, a.params); err != nil {
+			return arguments{}, err
+		}
+	}
+
+	return a, nil
+}
+
+// newFlagSet returns a flag set that parses the options into a, and the config file path into
+// configPath.
+func newFlagSet(name string, a *arguments, configPath *string) *flag.FlagSet {
+	f := flag.NewFlagSet(name, flag.ContinueOnError)
+	f.SetOutput(ioutil.Discard)
+	f.StringVar(configPath, "config", *configPath, "")
+	f.StringVar(&a.placeholder, "placeholder", a.placeholder, "")
+	f.BoolVar(&a.opts.shell, "shell", a.opts.shell, "")
+	f.Var((*prefixValue)(&a.opts.prefix), "prefix", "")
+	f.StringVar(&a.opts.logFormat, "log-format", a.opts.logFormat, "")
+	f.StringVar(&a.opts.logFile, "log-file", a.opts.logFile, "")
+	f.Var((*sizeValue)(&a.opts.logMaxSize), "log-max-size", "")
+	f.IntVar(&a.opts.logKeep, "log-keep", a.opts.logKeep, "")
+	f.BoolVar(&a.opts.logCompress, "log-compress", a.opts.logCompress, "")
+	f.Var((*stringList)(&a.opts.env), "env", "")
+	f.StringVar(&a.opts.dir, "dir", a.opts.dir, "")
+	f.StringVar(&a.opts.releases, "releases", a.opts.releases, "")
+	f.StringVar(&a.opts.release, "release", a.opts.release, "")
+	f.IntVar(&a.opts.instances, "instances", a.opts.instances, "")
+	f.StringVar(&a.opts.restart, "restart", a.opts.restart, "")
+	f.DurationVar(&a.opts.restartDelay, "restart-delay", a.opts.restartDelay, "")
+	f.DurationVar(&a.opts.restartMaxDelay, "restart-max-delay", a.opts.restartMaxDelay, "")
+	f.IntVar(&a.opts.restartLimit, "restart-limit", a.opts.restartLimit, "")
+	f.DurationVar(&a.opts.restartWindow, "restart-window", a.opts.restartWindow, "")
+	f.BoolVar(&a.opts.killOrphans, "kill-orphans", a.opts.killOrphans, "")
+	f.Var((*signalValue)(&a.opts.stopSignal), "stop-signal", "")
+	f.DurationVar(&a.opts.stopTimeout, "stop-timeout", a.opts.stopTimeout, "")
+	f.Var((*signalValue)(&a.opts.rotateSignal), "rotate-signal", "")
+	f.Var((*signalMappingList)(&a.opts.forward), "forward", "")
+	f.StringVar(&a.opts.httpProbe, "http-probe", a.opts.httpProbe, "")
+	f.StringVar(&a.opts.tcpProbe, "tcp-probe", a.opts.tcpProbe, "")
+	f.DurationVar(&a.opts.probeTimeout, "probe-timeout", a.opts.probeTimeout, "")
+	f.DurationVar(&a.opts.probeInterval, "probe-interval", a.opts.probeInterval, "")
+	f.StringVar(&a.opts.httpProxy, "http-proxy", a.opts.httpProxy, "")
+	f.StringVar(&a.opts.tcpProxy, "tcp-proxy", a.opts.tcpProxy, "")
+	f.StringVar(&a.opts.upstream, "upstream", a.opts.upstream, "")
+	f.Var((*stringList)(&a.opts.listen), "listen", "")
+	f.StringVar(&a.opts.controlSocket, "control", a.opts.controlSocket, "")
+	f.StringVar(&a.opts.metrics, "metrics", a.opts.metrics, "")
+	f.StringVar(&a.opts.admin, "admin", a.opts.admin, "")
+	return f
+}
+
+func flagName(key string) string {
+	return "-" + key
+}
 
-	overlap, err := time.ParseDuration(overlapStr)
-	if err != nil || overlap < 0 {
-		return arguments{}, fmt.Errorf("Invalid overlap: '%s'", osArgs[3])
+// checkArguments returns an error if the placeholder or the options are invalid. name formats the
+// name of an option, given its flag name without the leading dash, for the error message.
+func checkArguments(a arguments, name func(key string) string) error {
+	opts := a.opts
+	if a.placeholder == "" {
+		return fmt.Errorf("Invalid %s: '%s'", name("placeholder"), a.placeholder)
 	}
+	switch opts.logFormat {
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("Invalid %s: '%s'", name("log-format"), opts.logFormat)
+	}
+	if opts.logKeep < 0 {
+		return fmt.Errorf("Invalid %s: '%d'", name("log-keep"), opts.logKeep)
+	}
+	if opts.logFile == "" {
+		switch {
+		case opts.logMaxSize > 0:
+			return fmt.Errorf("Missing %s for %s", name("log-file"), name("log-max-size"))
+		case opts.logKeep > 0:
+			return fmt.Errorf("Missing %s for %s", name("log-file"), name("log-keep"))
+		case opts.logCompress:
+			return fmt.Errorf("Missing %s for %s", name("log-file"), name("log-compress"))
+		}
+	}
+	for _, e := range opts.env {
+		if strings.Index(e, "=") <= 0 {
+			return fmt.Errorf("Invalid %s: '%s'", name("env"), e)
+		}
+	}
+	if opts.releases != "" && opts.release == "" {
+		return fmt.Errorf("Missing %s for %s", name("release"), name("releases"))
+	}
+	if opts.release != "" && opts.releases == "" {
+		return fmt.Errorf("Missing %s for %s", name("releases"), name("release"))
+	}
+	if opts.instances < 1 {
+		return fmt.Errorf("Invalid %s: '%d'", name("instances"), opts.instances)
+	}
+	switch opts.restart {
+	case restartNever, restartOnFailure, restartAlways:
+	default:
+		return fmt.Errorf("Invalid %s: '%s'", name("restart"), opts.restart)
+	}
+	if opts.restartDelay <= 0 {
+		return fmt.Errorf("Invalid %s: '%v'", name("restart-delay"), opts.restartDelay)
+	}
+	if opts.restartMaxDelay < opts.restartDelay {
+		return fmt.Errorf("Invalid %s: '%v'", name("restart-max-delay"), opts.restartMaxDelay)
+	}
+	if opts.restartLimit < 0 {
+		return fmt.Errorf("Invalid %s: '%d'", name("restart-limit"), opts.restartLimit)
+	}
+	if opts.restartWindow <= 0 {
+		return fmt.Errorf("Invalid %s: '%v'", name("restart-window"), opts.restartWindow)
+	}
+	if opts.stopTimeout < 0 {
+		return fmt.Errorf("Invalid %s: '%v'", name("stop-timeout"), opts.stopTimeout)
+	}
+	if opts.killOrphans && !killOrphansSupported {
+		return fmt.Errorf("Cannot use %s outside of Linux", name("kill-orphans"))
+	}
+	// TERM and INT stop alternate itself, and cannot be used for anything else.
+	if opts.rotateSignal == syscall.SIGTERM || opts.rotateSignal == syscall.SIGINT {
+		return fmt.Errorf("Invalid %s: '%s'", name("rotate-signal"), signalName(opts.rotateSignal))
+	}
+	forwarded := map[syscall.Signal]bool{}
+	for _, m := range opts.forward {
+		if m.from == syscall.SIGTERM || m.from == syscall.SIGINT || m.from == opts.rotateSignal ||
+			forwarded[m.from] {
+			return fmt.Errorf("Invalid %s: '%s'", name("forward"), m)
+		}
+		forwarded[m.from] = true
+	}
+	// HUP reopens the log files, and cannot be used for anything else when they are set.
+	if opts.logFile != "" && opts.rotateSignal == syscall.SIGHUP {
+		return fmt.Errorf("Cannot use HUP for %s with %s", name("rotate-signal"), name("log-file"))
+	}
+	if opts.logFile != "" && forwarded[syscall.SIGHUP] {
+		return fmt.Errorf("Cannot use HUP for %s with %s", name("forward"), name("log-file"))
+	}
+	if opts.httpProbe != "" && opts.tcpProbe != "" {
+		return fmt.Errorf("Cannot use both %s and %s", name("http-probe"), name("tcp-probe"))
+	}
+	if opts.httpProxy != "" && opts.upstream == "" {
+		return fmt.Errorf("Missing %s for %s", name("upstream"), name("http-proxy"))
+	}
+	if opts.tcpProxy != "" && opts.upstream == "" {
+		return fmt.Errorf("Missing %s for %s", name("upstream"), name("tcp-proxy"))
+	}
+	if opts.admin != "" {
+		if err := checkAdminAddress(opts.admin); err != nil {
+			return fmt.Errorf("Invalid %s: '%s', %v", name("admin"), opts.admin, err)
+		}
+	}
+	if opts.probeTimeout <= 0 {
+		return fmt.Errorf("Invalid %s: '%v'", name("probe-timeout"), opts.probeTimeout)
+	}
+	if opts.probeInterval <= 0 {
+		return fmt.Errorf("Invalid %s: '%v'", name("probe-interval"), opts.probeInterval)
+	}
+	return nil
+}
+
+// stringList is a flag value that collects the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
 
-	return arguments{command, params, overlap}, nil
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
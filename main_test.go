@@ -2,10 +2,18 @@ package main
 
 import (
 	"reflect"
+	"syscall"
 	"testing"
 	"time"
 )
 
+// withOptions returns the default options, as modified by f.
+func withOptions(f func(o *options)) options {
+	opts := newOptions()
+	f(&opts)
+	return opts
+}
+
 func TestParseArguments(t *testing.T) {
 	tests := []struct {
 		iOsArgs []string
@@ -38,19 +46,286 @@ func TestParseArguments(t *testing.T) {
 		},
 		{
 			[]string{"alternate", "cmd", "val0", "0"},
-			arguments{"cmd", []string{"val0"}, 0}, "",
+			arguments{"cmd", "%alt", []string{"val0"}, 0, newOptions()}, "",
 		},
 		{
 			[]string{"alternate", "cmd", "val0", "5s"},
-			arguments{"cmd", []string{"val0"}, 5 * time.Second}, "",
+			arguments{"cmd", "%alt", []string{"val0"}, 5 * time.Second, newOptions()}, "",
 		},
 		{
 			[]string{"alternate", "cmd", "val0", "123ms"},
-			arguments{"cmd", []string{"val0"}, 123 * time.Millisecond}, "",
+			arguments{"cmd", "%alt", []string{"val0"}, 123 * time.Millisecond, newOptions()}, "",
 		},
 		{
 			[]string{"alternate", "cmd", "val0", "val%1", "val 2", "", "0"},
-			arguments{"cmd", []string{"val0", "val%1", "val 2", ""}, 0}, "",
+			arguments{"cmd", "%alt", []string{"val0", "val%1", "val 2", ""}, 0, newOptions()}, "",
+		},
+		{
+			[]string{"alternate", "-http-probe", "http://localhost:%alt/", "-probe-timeout", "5s",
+				"-probe-interval", "100ms", "cmd", "val0", "0"},
+			arguments{"cmd", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.httpProbe = "http://localhost:%alt/"
+				o.probeTimeout = 5 * time.Second
+				o.probeInterval = 100 * time.Millisecond
+			})}, "",
+		},
+		{
+			[]string{"alternate", "-control", "/run/alt.sock", "cmd", "val0", "0"},
+			arguments{"cmd", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.controlSocket = "/run/alt.sock"
+			})}, "",
+		},
+		{
+			[]string{"alternate", "-http-proxy", ":80", "-upstream", "127.0.0.1:%alt", "cmd",
+				"val0", "0"},
+			arguments{"cmd", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.httpProxy = ":80"
+				o.upstream = "127.0.0.1:%alt"
+			})}, "",
+		},
+		{
+			[]string{"alternate", "-http-proxy", ":80", "cmd", "val0", "0"},
+			arguments{}, "Missing -upstream for -http-proxy",
+		},
+		{
+			[]string{"alternate", "-listen", ":80", "-listen", ":443", "cmd", "val0", "0"},
+			arguments{"cmd", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.listen = []string{":80", ":443"}
+			})}, "",
+		},
+		{
+			[]string{"alternate", "-placeholder", "{}", "cmd {}", "val0", "0"},
+			arguments{"cmd {}", "{}", []string{"val0"}, 0, newOptions()}, "",
+		},
+		{
+			[]string{"alternate", "cmd %{port} %{admin}", "port=1,admin=2", "port=3,admin=4", "0"},
+			arguments{"cmd %{port} %{admin}", "%alt", []string{"port=1,admin=2", "port=3,admin=4"},
+				0, newOptions()}, "",
+		},
+		{
+			[]string{"alternate", "cmd %{port} %{admin}", "port=1,admin=2", "port=3", "0"},
+			arguments{}, "Parameter 'port=3' has no value for placeholder '%{admin}'",
+		},
+		{
+			[]string{"alternate", "-tcp-probe", "127.0.0.1:%{port}", "cmd", "3000", "0"},
+			arguments{}, "Parameter '3000' has no value for placeholder '%{port}'",
+		},
+		{
+			[]string{"alternate", "-env", "PORT=%{port}", "-env", "SLOT=blue", "-dir",
+				"/srv/%{port}", "cmd", "port=3000", "0"},
+			arguments{"cmd", "%alt", []string{"port=3000"}, 0, withOptions(func(o *options) {
+				o.env = []string{"PORT=%{port}", "SLOT=blue"}
+				o.dir = "/srv/%{port}"
+			})}, "",
+		},
+		{
+			[]string{"alternate", "-env", "PORT", "cmd", "val0", "0"},
+			arguments{}, "Invalid -env: 'PORT'",
+		},
+		{
+			[]string{"alternate", "-env", "SLOT=%{slot}", "cmd", "port=3000", "0"},
+			arguments{}, "Parameter 'port=3000' has no value for placeholder '%{slot}'",
+		},
+		{
+			[]string{"alternate", "-releases", "/srv/releases", "-release", "v1",
+				"%{release}/bin/server", "val0", "0"},
+			arguments{"%{release}/bin/server", "%alt", []string{"val0"}, 0,
+				withOptions(func(o *options) {
+					o.releases = "/srv/releases"
+					o.release = "v1"
+				})}, "",
+		},
+		{
+			[]string{"alternate", "-releases", "/srv/releases", "cmd", "val0", "0"},
+			arguments{}, "Missing -release for -releases",
+		},
+		{
+			[]string{"alternate", "%{release}/bin/server", "val0", "0"},
+			arguments{}, "Parameter 'val0' has no value for placeholder '%{release}'",
+		},
+		{
+			[]string{"alternate", "-instances", "2", "cmd", "val0", "val1", "val2", "0"},
+			arguments{"cmd", "%alt", []string{"val0", "val1", "val2"}, 0,
+				withOptions(func(o *options) {
+					o.instances = 2
+				})}, "",
+		},
+		{
+			[]string{"alternate", "-instances", "2", "cmd", "val0", "val1", "0"},
+			arguments{}, "Not enough parameters for 2 instances: [\"val0\" \"val1\"]",
+		},
+		{
+			[]string{"alternate", "-instances", "0", "cmd", "val0", "0"},
+			arguments{}, "Invalid -instances: '0'",
+		},
+		{
+			[]string{"alternate", "-restart", "sometimes", "cmd", "val0", "0"},
+			arguments{}, "Invalid -restart: 'sometimes'",
+		},
+		{
+			[]string{"alternate", "-restart-delay", "1m", "cmd", "val0", "0"},
+			arguments{}, "Invalid -restart-max-delay: '30s'",
+		},
+		{
+			[]string{"alternate", "-stop-timeout", "-1s", "cmd", "val0", "0"},
+			arguments{}, "Invalid -stop-timeout: '-1s'",
+		},
+		{
+			[]string{"alternate", "-stop-signal", "QUIT", "-rotate-signal", "usr2", "-forward",
+				"HUP", "-forward", "SIGWINCH:USR1", "cmd", "val0", "0"},
+			arguments{"cmd", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.stopSignal = syscall.SIGQUIT
+				o.rotateSignal = syscall.SIGUSR2
+				o.forward = []signalMapping{
+					{syscall.SIGHUP, syscall.SIGHUP},
+					{syscall.SIGWINCH, syscall.SIGUSR1},
+				}
+			})}, "",
+		},
+		{
+			[]string{"alternate", "-kill-orphans", "cmd", "val0", "0"},
+			arguments{"cmd", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.killOrphans = true
+			})}, "",
+		},
+		{
+			[]string{"alternate", "-prefix", "param,host", "cmd", "val0", "0"},
+			arguments{}, "invalid value \"param,host\" for flag -prefix: unknown prefix field \"host\"",
+		},
+		{
+			[]string{"alternate", "-log-file", "/var/log/cmd-%alt-%{start}.log", "-log-max-size",
+				"10M", "-log-keep", "3", "-log-compress", "cmd", "val0", "0"},
+			arguments{"cmd", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.logFile = "/var/log/cmd-%alt-%{start}.log"
+				o.logMaxSize = 10 << 20
+				o.logKeep = 3
+				o.logCompress = true
+			})}, "",
+		},
+		{
+			[]string{"alternate", "-log-max-size", "10MB", "cmd", "val0", "0"},
+			arguments{}, "invalid value \"10MB\" for flag -log-max-size: invalid size \"10MB\"",
+		},
+		{
+			[]string{"alternate", "-log-keep", "3", "cmd", "val0", "0"},
+			arguments{}, "Missing -log-file for -log-keep",
+		},
+		{
+			[]string{"alternate", "-log-file", "cmd.log", "-forward", "HUP", "cmd", "val0", "0"},
+			arguments{}, "Cannot use HUP for -forward with -log-file",
+		},
+		{
+			[]string{"alternate", "-admin", "0.0.0.0:9101", "cmd", "val0", "0"},
+			arguments{}, `Invalid -admin: '0.0.0.0:9101', host "0.0.0.0" is not a loopback address`,
+		},
+		{
+			[]string{"alternate", "-log-format", "xml", "cmd", "val0", "0"},
+			arguments{}, "Invalid -log-format: 'xml'",
+		},
+		{
+			[]string{"alternate", "-stop-signal", "FOO", "cmd", "val0", "0"},
+			arguments{}, "invalid value \"FOO\" for flag -stop-signal: unknown signal \"FOO\"",
+		},
+		{
+			[]string{"alternate", "-rotate-signal", "TERM", "cmd", "val0", "0"},
+			arguments{}, "Invalid -rotate-signal: 'TERM'",
+		},
+		{
+			[]string{"alternate", "-forward", "USR1:HUP", "cmd", "val0", "0"},
+			arguments{}, "Invalid -forward: 'USR1:HUP'",
+		},
+		{
+			[]string{"alternate", "-shell", "cmd | cat", "val0", "0"},
+			arguments{"cmd | cat", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.shell = true
+			})}, "",
+		},
+		{
+			[]string{"alternate", "-placeholder", "", "cmd", "val0", "0"},
+			arguments{}, "Invalid -placeholder: ''",
+		},
+		{
+			[]string{"alternate", "-config", "testdata/missing.json"},
+			arguments{}, "Failed to read config file \"testdata/missing.json\", error: open " +
+				"testdata/missing.json: no such file or directory",
+		},
+		{
+			[]string{"alternate", "-config", "testdata/alternate.json"},
+			arguments{"/home/me/myserver 127.0.0.1:%alt", "%alt", []string{"3000", "3001"},
+				15 * time.Second, withOptions(func(o *options) {
+					o.httpProbe = "http://127.0.0.1:%alt/healthz"
+					o.probeTimeout = time.Minute
+					o.controlSocket = "/run/alternate.sock"
+				})}, "",
+		},
+		{
+			[]string{"alternate", "-config", "testdata/alternate.toml"},
+			arguments{"/home/me/myserver 127.0.0.1:%alt", "%alt", []string{"3000", "3001"},
+				15 * time.Second, withOptions(func(o *options) {
+					o.httpProbe = "http://127.0.0.1:%alt/healthz"
+					o.probeTimeout = time.Minute
+					o.controlSocket = "/run/alternate.sock"
+				})}, "",
+		},
+		{
+			// Flags and positional arguments take precedence over the config file.
+			[]string{"alternate", "-config", "testdata/alternate.json", "-probe-timeout", "5s",
+				"cmd", "val0", "0"},
+			arguments{"cmd", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.httpProbe = "http://127.0.0.1:%alt/healthz"
+				o.probeTimeout = 5 * time.Second
+				o.controlSocket = "/run/alternate.sock"
+			})}, "",
+		},
+		{
+			[]string{"alternate", "-config", "testdata/alternate.json", "-tcp-probe", ":%alt"},
+			arguments{}, `Cannot use both "http-probe" and -tcp-probe`,
+		},
+		{
+			// The command line completes the config file before the arguments are checked.
+			[]string{"alternate", "-config", "testdata/releases.json", "-release", "v1", "cmd",
+				"val0", "0"},
+			arguments{"cmd", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.releases = "/srv/releases"
+				o.release = "v1"
+				o.httpProxy = ":80"
+				o.upstream = "127.0.0.1:%alt"
+			})}, "",
+		},
+		{
+			[]string{"alternate", "-config", "testdata/releases.json", "cmd", "val0", "0"},
+			arguments{}, `Missing -release for "releases"`,
+		},
+		{
+			[]string{"alternate", "-config", "testdata/releases.json", "-release", "v1"},
+			arguments{}, `Invalid config file "testdata/releases.json": missing key "command"`,
+		},
+		{
+			[]string{"alternate", "-tcp-proxy", ":5432", "cmd", "val0", "0"},
+			arguments{}, "Missing -upstream for -tcp-proxy",
+		},
+		{
+			[]string{"alternate", "-http-probe", "http://localhost:%alt/", "cmd", "val0"},
+			arguments{}, "Not enough arguments",
+		},
+		{
+			[]string{"alternate", "-tcp-probe", "127.0.0.1:%alt", "cmd", "val0", "0"},
+			arguments{"cmd", "%alt", []string{"val0"}, 0, withOptions(func(o *options) {
+				o.tcpProbe = "127.0.0.1:%alt"
+			})}, "",
+		},
+		{
+			[]string{"alternate", "-http-probe", "http://localhost:%alt/", "-tcp-probe",
+				"127.0.0.1:%alt", "cmd", "val0", "0"},
+			arguments{}, "Cannot use both -http-probe and -tcp-probe",
+		},
+		{
+			[]string{"alternate", "-probe-timeout", "0", "cmd", "val0", "0"},
+			arguments{}, "Invalid -probe-timeout: '0s'",
+		},
+		{
+			[]string{"alternate", "-probe-interval", "-1s", "cmd", "val0", "0"},
+			arguments{}, "Invalid -probe-interval: '-1s'",
 		},
 	}
 
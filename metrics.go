@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rotationDurationBuckets are the upper bounds in seconds of the buckets of the rotation duration
+// histogram.
+var rotationDurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600}
+
+// metrics counts the events handled by the event loop, to expose them in the Prometheus text
+// format. It is only used from the event loop.
+type metrics struct {
+	rotations map[rotationOutcome]int
+	// durationBuckets counts the rotations that took at most each of rotationDurationBuckets.
+	durationBuckets []int
+	durationSum     time.Duration
+	durationCount   int
+	// overlap is the total time spent running the next command alongside the current command
+	// before taking over.
+	overlap time.Duration
+	exits   map[exitKey]int
+}
+
+type exitKey struct {
+	param string
+	code  int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		rotations:       map[rotationOutcome]int{},
+		durationBuckets: make([]int, len(rotationDurationBuckets)),
+		exits:           map[exitKey]int{},
+	}
+}
+
+// rotationEnded records a rotation that ended with outcome after running for d.
+func (m *metrics) rotationEnded(outcome rotationOutcome, d time.Duration) {
+	m.rotations[outcome]++
+	for i, b := range rotationDurationBuckets {
+		if d.Seconds() <= b {
+			m.durationBuckets[i]++
+		}
+	}
+	m.durationSum += d
+	m.durationCount++
+}
+
+// rotationFailedToStart records a rotation that failed because its first command could not be
+// run. Since the rotation never started, it is counted but has no duration.
+func (m *metrics) rotationFailedToStart() {
+	m.rotations[rotationFailed]++
+}
+
+// exited records a command run with param that exited with code.
+func (m *metrics) exited(param string, code int) {
+	m.exits[exitKey{param, code}]++
+}
+
+// labelEscaper escapes the label values of the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	bytes.Buffer
+}
+
+func (w *metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of the metric name, with labels given as name and value pairs.
+func (w *metricsWriter) sample(name string, value float64, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+		}
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// render returns the metrics of the state s at the time now in the Prometheus text format.
+func (m *metrics) render(s *state, now time.Time) string {
+	var w metricsWriter
+
+	w.header("alternate_rotations_total", "counter", "Number of rotations by outcome.")
+	for _, o := range []rotationOutcome{rotationSucceeded, rotationRolledBack, rotationCancelled,
+		rotationFailed} {
+		w.sample("alternate_rotations_total", float64(m.rotations[o]), "outcome",
+			strings.Replace(string(o), " ", "_", -1))
+	}
+
+	w.header("alternate_rotation_duration_seconds", "histogram",
+		"Time from the start of a rotation to its end.")
+	for i, b := range rotationDurationBuckets {
+		w.sample("alternate_rotation_duration_seconds_bucket", float64(m.durationBuckets[i]),
+			"le", strconv.FormatFloat(b, 'g', -1, 64))
+	}
+	w.sample("alternate_rotation_duration_seconds_bucket", float64(m.durationCount), "le", "+Inf")
+	w.sample("alternate_rotation_duration_seconds_sum", m.durationSum.Seconds())
+	w.sample("alternate_rotation_duration_seconds_count", float64(m.durationCount))
+
+	w.header("alternate_overlap_seconds_total", "counter",
+		"Time spent running the next command alongside the current command before taking over.")
+	w.sample("alternate_overlap_seconds_total", m.overlap.Seconds())
+
+	params := s.rotation.s
+	w.header("alternate_restarts_total", "counter", "Number of restarts of the commands.")
+	for _, p := range params {
+		w.sample("alternate_restarts_total", float64(s.restarts[p]), "param", p)
+	}
+
+	w.header("alternate_command_exits_total", "counter",
+		"Number of exits of the commands by exit code.")
+	keys := make([]exitKey, 0, len(m.exits))
+	for k := range m.exits {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].param != keys[j].param {
+			return keys[i].param < keys[j].param
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, k := range keys {
+		w.sample("alternate_command_exits_total", float64(m.exits[k]), "param", k.param, "code",
+			strconv.Itoa(k.code))
+	}
+
+	w.header("alternate_active", "gauge", "Whether the parameter is active (1) or not (0).")
+	for _, p := range params {
+		active := 0.0
+		if s.isActive(p) {
+			active = 1
+		}
+		w.sample("alternate_active", active, "param", p)
+	}
+
+	w.header("alternate_command_uptime_seconds", "gauge",
+		"Time since the running command with the parameter was started.")
+	for _, p := range params {
+		if t, ok := s.started[p]; ok {
+			w.sample("alternate_command_uptime_seconds", now.Sub(t).Seconds(), "param", p)
+		}
+	}
+
+	return w.String()
+}
+
+// serveMetrics serves the metrics over HTTP on l until l is closed. Each request to /metrics is
+// forwarded on requests, and receives the metrics rendered by the event loop. done must be closed
+// when requests stops being read.
+func serveMetrics(l net.Listener, requests chan chan string, done chan struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		reply := make(chan string, 1)
+		select {
+		case requests <- reply:
+			select {
+			case body := <-reply:
+				w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+				w.Write([]byte(body))
+				return
+			case <-done:
+			}
+		case <-done:
+		}
+		http.Error(w, exitingMessage, http.StatusServiceUnavailable)
+	})
+	http.Serve(l, mux)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsRender(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := newState([]string{"val0", `va"l1`}, 1)
+	s.set("val0", &exec.Cmd{})
+	s.started["val0"] = now.Add(-90 * time.Second)
+	s.restarted("val0")
+
+	m := s.metrics
+	m.rotationEnded(rotationSucceeded, 3*time.Second)
+	m.rotationEnded(rotationRolledBack, 45*time.Second)
+	m.rotationFailedToStart()
+	m.overlap = 1500 * time.Millisecond
+	m.exited(`va"l1`, 143)
+	m.exited(`va"l1`, 143)
+	m.exited("val0", 1)
+
+	expected := []string{
+		"# TYPE alternate_rotations_total counter",
+		`alternate_rotations_total{outcome="succeeded"} 1`,
+		`alternate_rotations_total{outcome="rolled_back"} 1`,
+		`alternate_rotations_total{outcome="cancelled"} 0`,
+		`alternate_rotations_total{outcome="failed"} 1`,
+		"# TYPE alternate_rotation_duration_seconds histogram",
+		`alternate_rotation_duration_seconds_bucket{le="1"} 0`,
+		`alternate_rotation_duration_seconds_bucket{le="5"} 1`,
+		`alternate_rotation_duration_seconds_bucket{le="30"} 1`,
+		`alternate_rotation_duration_seconds_bucket{le="60"} 2`,
+		`alternate_rotation_duration_seconds_bucket{le="+Inf"} 2`,
+		"alternate_rotation_duration_seconds_sum 48",
+		"alternate_rotation_duration_seconds_count 2",
+		"alternate_overlap_seconds_total 1.5",
+		`alternate_restarts_total{param="val0"} 1`,
+		`alternate_restarts_total{param="va\"l1"} 0`,
+		`alternate_command_exits_total{param="va\"l1",code="143"} 2`,
+		`alternate_command_exits_total{param="val0",code="1"} 1`,
+		`alternate_active{param="val0"} 1`,
+		`alternate_active{param="va\"l1"} 0`,
+		`alternate_command_uptime_seconds{param="val0"} 90`,
+	}
+	lines := strings.Split(m.render(s, now), "\n")
+	for _, e := range expected {
+		found := false
+		for _, l := range lines {
+			if l == e {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("Expected metrics to contain line %q, was:\n%s", e, strings.Join(lines, "\n"))
+		}
+	}
+}
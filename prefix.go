@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fields that can be used to prefix the lines written by the commands.
+const (
+	prefixTime  = "time"
+	prefixParam = "param"
+	prefixPID   = "pid"
+)
+
+// maxLineLength is the length after which a line that has no line break yet is written anyway.
+const maxLineLength = 64 * 1024
+
+// syncWriter serializes the writes to w, so that the writes of several commands do not interleave.
+type syncWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func newSyncWriter(w io.Writer) *syncWriter {
+	return &syncWriter{w: w}
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.w.Write(p)
+}
+
+// prefixWriter buffers the output of a command, and writes it to w one whole line at a time, each
+// line preceded by a prefix. A prefixWriter must not be written to concurrently, which is the case
+// when it is used as the Stdout or Stderr of a single exec.Cmd.
+type prefixWriter struct {
+	w      io.Writer
+	prefix func() string
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, prefix func() string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: prefix}
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 || i >= maxLineLength {
+			if len(w.buf) < maxLineLength {
+				return len(p), nil
+			}
+			i = maxLineLength - 1
+		}
+		if err := w.writeLine(w.buf[:i+1]); err != nil {
+			return len(p), err
+		}
+		w.buf = w.buf[i+1:]
+	}
+}
+
+// Flush writes the last line if it does not end with a line break.
+func (w *prefixWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.writeLine(append(w.buf, '\n'))
+	w.buf = nil
+	return err
+}
+
+// writeLine writes the prefix and the line with a single call to Write.
+func (w *prefixWriter) writeLine(line []byte) error {
+	_, err := w.w.Write(append([]byte(w.prefix()), line...))
+	return err
+}
+
+// cmdPrefix returns a function that returns the prefix of the lines written by the command c run
+// with param, made of the given fields, such as "2015-06-01T12:00:00.000Z 3000 1234 | ". The
+// prefix is empty if there are no fields.
+func cmdPrefix(fields []string, param string, c *exec.Cmd) func() string {
+	return func() string {
+		if len(fields) == 0 {
+			return ""
+		}
+		values := make([]string, len(fields))
+		for i, f := range fields {
+			switch f {
+			case prefixTime:
+				values[i] = time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+			case prefixParam:
+				values[i] = param
+			case prefixPID:
+				if c.Process != nil {
+					values[i] = fmt.Sprintf("%d", c.Process.Pid)
+				}
+			}
+		}
+		return strings.Join(values, " ") + " | "
+	}
+}
+
+// parsePrefix parses a comma-separated list of prefix fields, such as "param,pid".
+func parsePrefix(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.Split(s, ",")
+	for _, f := range fields {
+		switch f {
+		case prefixTime, prefixParam, prefixPID:
+		default:
+			return nil, fmt.Errorf("unknown prefix field %q", f)
+		}
+	}
+	return fields, nil
+}
+
+// prefixValue is a flag value that parses a comma-separated list of prefix fields.
+type prefixValue []string
+
+func (v *prefixValue) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *prefixValue) Set(s string) error {
+	fields, err := parsePrefix(s)
+	if err != nil {
+		return err
+	}
+	*v = fields
+	return nil
+}
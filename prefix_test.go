@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordWriter records the byte slices passed to each call to Write.
+type recordWriter struct {
+	writes []string
+}
+
+func (w *recordWriter) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestPrefixWriter(t *testing.T) {
+	long := strings.Repeat("a", maxLineLength)
+	tests := []struct {
+		iWrites []string
+		oWrites []string
+	}{
+		{[]string{"one\n"}, []string{"p | one\n"}},
+		{[]string{"o", "ne\ntw", "o\n"}, []string{"p | one\n", "p | two\n"}},
+		{[]string{"one\ntwo\n\n"}, []string{"p | one\n", "p | two\n", "p | \n"}},
+		// The last line is flushed even without a line break.
+		{[]string{"one\ntwo"}, []string{"p | one\n", "p | two\n"}},
+		// Lines are written once they reach the maximum length.
+		{[]string{long[:10], long[10:] + "b\n"}, []string{"p | " + long, "p | b\n"}},
+	}
+
+	for i, test := range tests {
+		w := &recordWriter{}
+		pw := newPrefixWriter(w, func() string { return "p | " })
+		for _, s := range test.iWrites {
+			if n, err := pw.Write([]byte(s)); n != len(s) || err != nil {
+				t.Errorf("For test #%d, expected Write to return %d and nil, but was %d and %v",
+					i, len(s), n, err)
+			}
+		}
+		pw.Flush()
+		if !reflect.DeepEqual(test.oWrites, w.writes) {
+			t.Errorf("For test #%d with writes %q, expected writes %q, but was %q", i,
+				test.iWrites, test.oWrites, w.writes)
+		}
+	}
+}
+
+func TestPrefixWriterNoPrefix(t *testing.T) {
+	var b bytes.Buffer
+	pw := newPrefixWriter(&b, cmdPrefix(nil, "param0", nil))
+	pw.Write([]byte("one\ntwo"))
+	pw.Flush()
+	if b.String() != "one\ntwo\n" {
+		t.Errorf("Expected output %q, but was %q", "one\ntwo\n", b.String())
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		iS      string
+		oFields []string
+		oErr    string
+	}{
+		{"", nil, ""},
+		{"param", []string{"param"}, ""},
+		{"time,param,pid", []string{"time", "param", "pid"}, ""},
+		{"param,host", nil, `unknown prefix field "host"`},
+	}
+
+	for i, test := range tests {
+		fields, err := parsePrefix(test.iS)
+		if !reflect.DeepEqual(test.oFields, fields) || !sameError(err, test.oErr) {
+			t.Errorf("For test #%d with %q, expected fields %q and error %q, but was %q and %v",
+				i, test.iS, test.oFields, test.oErr, fields, err)
+		}
+	}
+}
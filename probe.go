@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// probeFunc checks once whether the command run with the given parameter is ready, giving up after
+// the given timeout. It returns nil if the command is ready, or an error describing why it is not.
+type probeFunc func(param string, timeout time.Duration) error
+
+// readiness is the outcome of waiting for the next command of a transition to become ready. err is
+// nil if the command became ready in time.
+type readiness struct {
+	transition *transition
+	err        error
+}
+
+// httpProbe returns a probe that sends a GET request to the given URL, with the placeholders
+// expanded for the parameter, and succeeds if the response has a 2xx status code.
+func httpProbe(url, placeholder string) probeFunc {
+	return func(param string, timeout time.Duration) error {
+		u := expand(url, placeholder, param)
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get(u)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, resp.Body)
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("GET %s returned status %d", u, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// tcpProbe returns a probe that opens a TCP connection to the given address, with the placeholders
+// expanded for the parameter, and succeeds if the connection is established.
+func tcpProbe(address, placeholder string) probeFunc {
+	return func(param string, timeout time.Duration) error {
+		a := expand(address, placeholder, param)
+		conn, err := net.DialTimeout("tcp", a, timeout)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+	}
+}
+
+// waitReady calls probe with the parameter of the transition every interval until it succeeds or
+// the timeout has elapsed, then sends the outcome on ready. Each attempt may take as long as the
+// time left before the timeout, which can be longer than the interval. waitReady returns early if
+// the transition ends in the meantime.
+func waitReady(l *logger, probe probeFunc, t *transition, interval, timeout time.Duration,
+	ready chan readiness) {
+
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		left := time.Until(deadline)
+		if left <= 0 {
+			// A zero timeout would let the attempt run forever.
+			left = time.Millisecond
+		}
+		err := probe(t.param, left)
+		if err == nil {
+			l.event("probe_ready", fields{"param": t.param, "attempts": attempt},
+				"Readiness probe for command with parameter %q succeeded after %d attempt(s)\n",
+				t.param, attempt)
+			sendReadiness(readiness{t, nil}, ready)
+			return
+		}
+
+		l.event("probe_attempt", fields{"param": t.param, "attempt": attempt, "error": err},
+			"Readiness probe attempt #%d for command with parameter %q failed, error: %v\n",
+			attempt, t.param, err)
+		if time.Now().Add(interval).After(deadline) {
+			l.event("probe_timeout", fields{"param": t.param, "attempts": attempt},
+				"Readiness probe for command with parameter %q gave up after %d attempt(s)\n",
+				t.param, attempt)
+			sendReadiness(readiness{t, fmt.Errorf("not ready after %v, last error: %v",
+				timeout, err)}, ready)
+			return
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func sendReadiness(r readiness, ready chan readiness) {
+	select {
+	case ready <- r:
+	case <-r.transition.done:
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitReadySlowProbe(t *testing.T) {
+	// The health endpoint takes longer to answer than the probe interval, but less than the probe
+	// timeout.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	probe := httpProbe(server.URL+"/%alt", "%alt")
+	tr := newTransition("healthz", "", nil)
+	ready := make(chan readiness, 1)
+	waitReady(newLogger(ioutil.Discard, logFormatText), probe, tr, 10*time.Millisecond, time.Second,
+		ready)
+	if r := <-ready; r.err != nil {
+		t.Errorf("Expected the probe to succeed, but got error %v", r.err)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "syscall"
+
+const killOrphansSupported = true
+
+// sysProcAttr returns the attributes of the processes of the commands. Each command runs in its own
+// process group, so that signals can be sent to all the processes it starts. If killOrphans is
+// true, the command also receives a KILL signal when alternate exits.
+func sysProcAttr(killOrphans bool) *syscall.SysProcAttr {
+	a := &syscall.SysProcAttr{Setpgid: true}
+	if killOrphans {
+		a.Pdeathsig = syscall.SIGKILL
+	}
+	return a
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "syscall"
+
+const killOrphansSupported = false
+
+// sysProcAttr returns the attributes of the processes of the commands. Each command runs in its own
+// process group, so that signals can be sent to all the processes it starts. killOrphans is not
+// supported outside of Linux.
+func sysProcAttr(killOrphans bool) *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
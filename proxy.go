@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync/atomic"
+)
+
+// upstream tracks the address that an embedded proxy forwards to, which is the upstream template
+// with the placeholders expanded for the current parameter.
+type upstream struct {
+	log         *logger
+	template    string
+	placeholder string
+	address     atomic.Value
+}
+
+// switchTo makes the upstream point to the address of the given parameter.
+func (u *upstream) switchTo(param string) {
+	a := expand(u.template, u.placeholder, param)
+	u.log.event("proxy_switch", fields{"param": param, "upstream": a},
+		"Proxy now forwarding to upstream %q\n", a)
+	u.address.Store(a)
+}
+
+func (u *upstream) current() string {
+	return u.address.Load().(string)
+}
+
+// httpProxy is a reverse proxy that forwards HTTP requests to the upstream of the current
+// parameter.
+type httpProxy struct {
+	upstream
+}
+
+func newHTTPProxy(l *logger, template, placeholder string) *httpProxy {
+	return &httpProxy{upstream{log: l, template: template, placeholder: placeholder}}
+}
+
+// serve forwards the HTTP requests received on l until l is closed. Requests that are already
+// being forwarded when the upstream switches are not interrupted.
+func (p *httpProxy) serve(l net.Listener) {
+	rp := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = p.current()
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			p.log.event("proxy_error", fields{"upstream": req.URL.Host, "error": err},
+				"Failed to forward HTTP request to upstream %q, error: %v\n", req.URL.Host, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	http.Serve(l, rp)
+}
+
+// tcpProxy is a layer-4 proxy that forwards TCP connections to the upstream of the current
+// parameter.
+type tcpProxy struct {
+	upstream
+}
+
+func newTCPProxy(l *logger, template, placeholder string) *tcpProxy {
+	return &tcpProxy{upstream{log: l, template: template, placeholder: placeholder}}
+}
+
+// serve forwards the TCP connections accepted on l until l is closed. Connections that are already
+// being forwarded when the upstream switches are kept open until either end closes them, which
+// lets them drain until the previous command exits.
+func (p *tcpProxy) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go p.forward(conn)
+	}
+}
+
+func (p *tcpProxy) forward(conn net.Conn) {
+	defer conn.Close()
+
+	a := p.current()
+	up, err := net.Dial("tcp", a)
+	if err != nil {
+		p.log.event("proxy_error", fields{"upstream": a, "error": err},
+			"Failed to connect to upstream %q, error: %v\n", a, err)
+		return
+	}
+	defer up.Close()
+
+	done := make(chan struct{}, 2)
+	go pipe(up, conn, done)
+	go pipe(conn, up, done)
+	<-done
+	<-done
+}
+
+// pipe copies from src to dst until src is closed, then closes the write side of dst.
+func pipe(dst, src net.Conn, done chan struct{}) {
+	io.Copy(dst, src)
+	if c, ok := dst.(*net.TCPConn); ok {
+		c.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	done <- struct{}{}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// releasePlaceholder is replaced by the directory of the release that a command is run from.
+const releasePlaceholder = "%{release}"
+
+// releaseDir returns the directory of the release with the given identifier under the releases
+// directory, or an error if the identifier is invalid or the directory does not exist.
+func releaseDir(releases, id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.Contains(id, "/") {
+		return "", fmt.Errorf("invalid release %q", id)
+	}
+	dir := path.Join(releases, id)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return "", fmt.Errorf("release %q not found: %v", id, err)
+	}
+	if !fi.IsDir() {
+		return "", fmt.Errorf("release %q not found: %s is not a directory", id, dir)
+	}
+	return dir, nil
+}
+
+// expandRelease returns s with every occurrence of the release placeholder replaced by dir.
+func expandRelease(s, dir string) string {
+	return strings.Replace(s, releasePlaceholder, dir, -1)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Restart policies for the commands that exit while they are active.
+const (
+	restartNever     = "never"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+)
+
+// restarter decides whether the commands that exit while they are active are restarted, and when.
+type restarter struct {
+	policy   string
+	delay    time.Duration
+	maxDelay time.Duration
+	limit    int
+	window   time.Duration
+	// history holds, for each parameter, the times of the restarts scheduled within the window.
+	history map[string][]time.Time
+	// pending is the number of restarts scheduled but not run yet.
+	pending int
+}
+
+func newRestarter(opts options) *restarter {
+	return &restarter{
+		opts.restart,
+		opts.restartDelay,
+		opts.restartMaxDelay,
+		opts.restartLimit,
+		opts.restartWindow,
+		map[string][]time.Time{},
+		0,
+	}
+}
+
+// wants returns true if the policy restarts a command that exited, with a failure or not.
+func (r *restarter) wants(failed bool) bool {
+	return r.policy == restartAlways || (r.policy == restartOnFailure && failed)
+}
+
+// schedule records a restart of the command with param at now, and returns the delay to wait
+// before running it: the initial delay, doubled for each restart of param within the window, up to
+// the maximum delay. It returns an error instead if param has already been restarted as many times
+// as the limit within the window.
+func (r *restarter) schedule(param string, now time.Time) (time.Duration, error) {
+	var recent []time.Time
+	for _, t := range r.history[param] {
+		if now.Sub(t) < r.window {
+			recent = append(recent, t)
+		}
+	}
+	r.history[param] = recent
+
+	if r.limit > 0 && len(recent) >= r.limit {
+		return 0, fmt.Errorf("restarted %d times in the last %v", len(recent), r.window)
+	}
+
+	d := r.delay
+	for i := 0; i < len(recent) && d < r.maxDelay; i++ {
+		d *= 2
+	}
+	if d > r.maxDelay {
+		d = r.maxDelay
+	}
+
+	r.history[param] = append(recent, now)
+	r.pending++
+	return d, nil
+}
+
+// restartAfter sends param on restart after the delay d, unless done is closed first.
+func restartAfter(d time.Duration, param string, restart chan string, done chan struct{}) {
+	select {
+	case <-time.After(d):
+		select {
+		case restart <- param:
+		case <-done:
+		}
+	case <-done:
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestarterWants(t *testing.T) {
+	tests := []struct {
+		iPolicy string
+		iFailed bool
+		oWants  bool
+	}{
+		{restartNever, false, false},
+		{restartNever, true, false},
+		{restartOnFailure, false, false},
+		{restartOnFailure, true, true},
+		{restartAlways, false, true},
+		{restartAlways, true, true},
+	}
+
+	for i, test := range tests {
+		opts := newOptions()
+		opts.restart = test.iPolicy
+		if wants := newRestarter(opts).wants(test.iFailed); wants != test.oWants {
+			t.Errorf("For test #%d with policy %q and failed %v, expected wants to be %v, but "+
+				"was %v", i, test.iPolicy, test.iFailed, test.oWants, wants)
+		}
+	}
+}
+
+func TestRestarterSchedule(t *testing.T) {
+	opts := newOptions()
+	opts.restartDelay = time.Second
+	opts.restartMaxDelay = 5 * time.Second
+	opts.restartLimit = 5
+	opts.restartWindow = time.Minute
+	r := newRestarter(opts)
+	start := time.Now()
+
+	tests := []struct {
+		iParam string
+		iAfter time.Duration
+		oDelay time.Duration
+		oErr   string
+	}{
+		{"param0", 0, time.Second, ""},
+		{"param0", time.Second, 2 * time.Second, ""},
+		{"param0", 3 * time.Second, 4 * time.Second, ""},
+		{"param1", 3 * time.Second, time.Second, ""},
+		{"param0", 7 * time.Second, 5 * time.Second, ""},
+		{"param0", 12 * time.Second, 5 * time.Second, ""},
+		{"param0", 17 * time.Second, 0, "restarted 5 times in the last 1m0s"},
+		// The restarts older than the window are forgotten.
+		{"param0", 62 * time.Second, 5 * time.Second, ""},
+		{"param0", 120 * time.Second, 2 * time.Second, ""},
+	}
+
+	for i, test := range tests {
+		d, err := r.schedule(test.iParam, start.Add(test.iAfter))
+		if d != test.oDelay || !sameError(err, test.oErr) {
+			t.Errorf("For test #%d with param %q after %v, expected delay %v and error %q, but "+
+				"was %v and %v", i, test.iParam, test.iAfter, test.oDelay, test.oErr, d, err)
+		}
+	}
+}
@@ -2,15 +2,18 @@ package main
 
 import "log"
 
-func newRotation(s []string) *rotation {
-	return &rotation{0, s}
+func newRotation(s []string, n int) *rotation {
+	return &rotation{0, n, s}
 }
 
+// rotation cycles through the parameters s, n of which are active at any time.
 type rotation struct {
 	i int
+	n int
 	s []string
 }
 
+// current returns the oldest active parameter, which is the next one to be replaced.
 func (r *rotation) current() string {
 	if r.i < 0 {
 		log.Fatalf("Cannot call rotation.current() when rotation.i is %d", r.i)
@@ -18,11 +21,31 @@ func (r *rotation) current() string {
 	return r.s[r.i%len(r.s)]
 }
 
+// newest returns the most recently activated parameter.
+func (r *rotation) newest() string {
+	if r.i < 0 {
+		log.Fatalf("Cannot call rotation.newest() when rotation.i is %d", r.i)
+	}
+	return r.s[(r.i+r.n-1)%len(r.s)]
+}
+
+// active returns the active parameters, from the oldest to the newest.
+func (r *rotation) active() []string {
+	if r.i < 0 {
+		log.Fatalf("Cannot call rotation.active() when rotation.i is %d", r.i)
+	}
+	a := make([]string, r.n)
+	for j := range a {
+		a[j] = r.s[(r.i+j)%len(r.s)]
+	}
+	return a
+}
+
 func (r *rotation) next() string {
-	if r.i < -1 {
+	if r.i < -r.n {
 		log.Fatalf("Cannot call rotation.next() when rotation.i is %d", r.i)
 	}
-	return r.s[(r.i+1)%len(r.s)]
+	return r.s[(r.i+r.n)%len(r.s)]
 }
 
 func (r *rotation) rotate() {
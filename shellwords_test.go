@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	tests := []struct {
+		iS     string
+		oWords []string
+		oErr   string
+	}{
+		{``, nil, ""},
+		{`   `, nil, ""},
+		{`a b  c`, []string{"a", "b", "c"}, ""},
+		{" a\tb\nc ", []string{"a", "b", "c"}, ""},
+		{`--name "my app"`, []string{"--name", "my app"}, ""},
+		{`--name 'my app'`, []string{"--name", "my app"}, ""},
+		{`--name=my\ app`, []string{"--name=my app"}, ""},
+		{`a"b c"d`, []string{"ab cd"}, ""},
+		{`'' ""`, []string{"", ""}, ""},
+		{`'a "b" \c'`, []string{`a "b" \c`}, ""},
+		{`"a 'b' \c \" \\ \$ \` + "`" + `"`, []string{`a 'b' \c " \ $ ` + "`"}, ""},
+		{`\'a\"`, []string{`'a"`}, ""},
+		{"a\\\nb", []string{"ab"}, ""},
+		{"\"a\\\nb\"", []string{"ab"}, ""},
+		{`$HOME`, []string{"$HOME"}, ""},
+		{`'abc`, nil, "unterminated single quote"},
+		{`"abc`, nil, "unterminated double quote"},
+		{`"abc\"`, nil, "unterminated double quote"},
+		{`abc\`, nil, "trailing backslash"},
+	}
+
+	for i, test := range tests {
+		words, err := splitWords(test.iS)
+		if !sameError(err, test.oErr) {
+			t.Errorf("For test #%d with s %q, expected err to be '%s', but was '%s'",
+				i, test.iS, test.oErr, err)
+		}
+		if !reflect.DeepEqual(test.oWords, words) {
+			t.Errorf("For test #%d with s %q, expected words to be %q, but was %q",
+				i, test.iS, test.oWords, words)
+		}
+	}
+}
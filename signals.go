@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// signals are the signals that can be used as stop, rotate or forwarded signals, by name.
+var signals = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"TERM":  syscall.SIGTERM,
+	"WINCH": syscall.SIGWINCH,
+	"ALRM":  syscall.SIGALRM,
+}
+
+// parseSignal returns the signal with the given name, such as "QUIT" or "SIGQUIT", in any case.
+func parseSignal(s string) (syscall.Signal, error) {
+	if sig, ok := signals[strings.TrimPrefix(strings.ToUpper(s), "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal %q", s)
+}
+
+// signalName returns the name of sig without the SIG prefix, such as "QUIT".
+func signalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	if sig == syscall.SIGKILL {
+		return "KILL"
+	}
+	return fmt.Sprintf("%d", int(sig))
+}
+
+// signalMapping forwards the signal from, received by alternate, to the active commands as the
+// signal to.
+type signalMapping struct {
+	from syscall.Signal
+	to   syscall.Signal
+}
+
+// parseSignalMapping parses a mapping such as "HUP", to forward HUP as is, or "HUP:USR2", to
+// forward HUP as USR2.
+func parseSignalMapping(s string) (signalMapping, error) {
+	parts := strings.SplitN(s, ":", 2)
+	from, err := parseSignal(parts[0])
+	if err != nil {
+		return signalMapping{}, err
+	}
+	to := from
+	if len(parts) == 2 {
+		if to, err = parseSignal(parts[1]); err != nil {
+			return signalMapping{}, err
+		}
+	}
+	return signalMapping{from, to}, nil
+}
+
+func (m signalMapping) String() string {
+	if m.from == m.to {
+		return signalName(m.from)
+	}
+	return signalName(m.from) + ":" + signalName(m.to)
+}
+
+// signalValue is a flag value that parses a signal name.
+type signalValue syscall.Signal
+
+func (v *signalValue) String() string {
+	return signalName(syscall.Signal(*v))
+}
+
+func (v *signalValue) Set(s string) error {
+	sig, err := parseSignal(s)
+	if err != nil {
+		return err
+	}
+	*v = signalValue(sig)
+	return nil
+}
+
+// signalMappingList is a flag value that collects the signal mappings of a repeated flag.
+type signalMappingList []signalMapping
+
+func (l *signalMappingList) String() string {
+	s := make([]string, len(*l))
+	for i, m := range *l {
+		s[i] = m.String()
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *signalMappingList) Set(s string) error {
+	m, err := parseSignalMapping(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, m)
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParseSignalMapping(t *testing.T) {
+	tests := []struct {
+		iS   string
+		oM   signalMapping
+		oErr string
+	}{
+		{"HUP", signalMapping{syscall.SIGHUP, syscall.SIGHUP}, ""},
+		{"sighup", signalMapping{syscall.SIGHUP, syscall.SIGHUP}, ""},
+		{"HUP:USR2", signalMapping{syscall.SIGHUP, syscall.SIGUSR2}, ""},
+		{"SIGQUIT:SIGTERM", signalMapping{syscall.SIGQUIT, syscall.SIGTERM}, ""},
+		{"", signalMapping{}, `unknown signal ""`},
+		{"HUP:", signalMapping{}, `unknown signal ""`},
+		{"KILL", signalMapping{}, `unknown signal "KILL"`},
+		{"9", signalMapping{}, `unknown signal "9"`},
+	}
+
+	for i, test := range tests {
+		m, err := parseSignalMapping(test.iS)
+		if m != test.oM || !sameError(err, test.oErr) {
+			t.Errorf("For test #%d with %q, expected mapping %v and error %q, but was %v and %v",
+				i, test.iS, test.oM, test.oErr, m, err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// namedPlaceholder matches the placeholders of named values, such as %{port}.
+var namedPlaceholder = regexp.MustCompile(`%\{([^{}]+)\}`)
+
+// slotValues returns the named values of param, if param is a comma-separated list of name=value
+// pairs such as "port=3000,admin=9000", or nil otherwise.
+func slotValues(param string) map[string]string {
+	values := map[string]string{}
+	for _, pair := range strings.Split(param, ",") {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil
+		}
+		values[pair[:i]] = pair[i+1:]
+	}
+	return values
+}
+
+// expand returns s with every occurrence of the placeholder replaced by param, and every
+// occurrence of %{name} replaced by the named value of param with that name. Named placeholders
+// without a matching value are left unchanged.
+func expand(s, placeholder, param string) string {
+	values := slotValues(param)
+	s = namedPlaceholder.ReplaceAllStringFunc(s, func(m string) string {
+		if v, ok := values[m[2:len(m)-1]]; ok {
+			return v
+		}
+		return m
+	})
+	return strings.Replace(s, placeholder, param, -1)
+}
+
+// expandAll returns a copy of a with every string expanded for param.
+func expandAll(a []string, placeholder, param string) []string {
+	b := make([]string, len(a))
+	for i, s := range a {
+		b[i] = expand(s, placeholder, param)
+	}
+	return b
+}
+
+// checkNamedPlaceholders returns an error if s contains a named placeholder that does not have a
+// matching value in every parameter.
+func checkNamedPlaceholders(s string, params []string) error {
+	for _, m := range namedPlaceholder.FindAllStringSubmatch(s, -1) {
+		for _, p := range params {
+			if _, ok := slotValues(p)[m[1]]; !ok {
+				return fmt.Errorf("Parameter '%s' has no value for placeholder '%s'", p, m[0])
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSlotValues(t *testing.T) {
+	tests := []struct {
+		iParam  string
+		oValues map[string]string
+	}{
+		{"3000", nil},
+		{"", nil},
+		{"port=3000", map[string]string{"port": "3000"}},
+		{"port=3000,admin=9000,slot=", map[string]string{"port": "3000", "admin": "9000", "slot": ""}},
+		{"port=3000,9000", nil},
+		{"=3000", nil},
+		{"url=http://host/?a=b", map[string]string{"url": "http://host/?a=b"}},
+	}
+
+	for i, test := range tests {
+		values := slotValues(test.iParam)
+		if !reflect.DeepEqual(test.oValues, values) {
+			t.Errorf("For test #%d with param %q, expected values to be %v, but was %v",
+				i, test.iParam, test.oValues, values)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		iS     string
+		iParam string
+		oS     string
+	}{
+		{"server %alt", "3000", "server 3000"},
+		{"server -port %alt -metrics-port %alt1", "3000", "server -port 3000 -metrics-port 30001"},
+		{"server -port %{port} -admin %{admin}", "port=3000,admin=9000",
+			"server -port 3000 -admin 9000"},
+		{"server -port %{port} -again %{port} %alt", "port=3000",
+			"server -port 3000 -again 3000 port=3000"},
+		{"server -port %{port} -admin %{admin}", "port=3000", "server -port 3000 -admin %{admin}"},
+		{"server -port %{port}", "3000", "server -port %{port}"},
+	}
+
+	for i, test := range tests {
+		s := expand(test.iS, placeholder, test.iParam)
+		if s != test.oS {
+			t.Errorf("For test #%d with s %q and param %q, expected %q, but was %q",
+				i, test.iS, test.iParam, test.oS, s)
+		}
+	}
+}
+
+func TestCheckNamedPlaceholders(t *testing.T) {
+	tests := []struct {
+		iS      string
+		iParams []string
+		oErr    string
+	}{
+		{"server %alt", []string{"3000", "3001"}, ""},
+		{"server %{port}", []string{"port=3000", "port=3001,admin=9001"}, ""},
+		{"server %{port} %{admin}", []string{"port=3000", "port=3001,admin=9001"},
+			"Parameter 'port=3000' has no value for placeholder '%{admin}'"},
+		{"server %{port}", []string{"3000"},
+			"Parameter '3000' has no value for placeholder '%{port}'"},
+	}
+
+	for i, test := range tests {
+		err := checkNamedPlaceholders(test.iS, test.iParams)
+		if !sameError(err, test.oErr) {
+			t.Errorf("For test #%d with s %q and params %q, expected err to be '%s', but was '%s'",
+				i, test.iS, test.iParams, test.oErr, err)
+		}
+	}
+}
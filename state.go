@@ -1,21 +1,48 @@
 package main
 
-import "os/exec"
+import (
+	"os/exec"
+	"time"
+)
 
-func newState(params []string) *state {
+func newState(params []string, instances int) *state {
 	return &state{
-		newRotation(params),
+		newRotation(params, instances),
 		map[string]*exec.Cmd{},
+		nil,
+		nil,
+		"",
+		"",
+		map[string]int{},
+		map[string]time.Time{},
+		false,
+		newMetrics(),
 	}
 }
 
 type state struct {
-	rotation *rotation
-	cmds     map[string]*exec.Cmd
+	rotation   *rotation
+	cmds       map[string]*exec.Cmd
+	transition *transition
+	watchFuncs []watchFunc
+	// release is the release that the current command is run from, and previousRelease the
+	// release that was current before it. Both are empty if releases are not used.
+	release         string
+	previousRelease string
+	// restarts is the number of times the command with each parameter has been restarted.
+	restarts map[string]int
+	// started is when the running command with each parameter was started.
+	started map[string]time.Time
+	// stopping is true once all commands have been asked to stop.
+	stopping bool
+	metrics  *metrics
 }
 
 type eachFunc func(p string, c *exec.Cmd)
 
+// watchFunc is called with the newest active parameter each time it changes.
+type watchFunc func(p string)
+
 // Functions that keep the state unchanged.
 
 func (s *state) current() (string, *exec.Cmd) {
@@ -23,11 +50,25 @@ func (s *state) current() (string, *exec.Cmd) {
 	return p, s.cmd(p)
 }
 
+// active returns the active parameters, from the oldest to the newest.
+func (s *state) active() []string {
+	return s.rotation.active()
+}
+
 func (s *state) next() (string, *exec.Cmd) {
 	p := s.rotation.next()
 	return p, s.cmd(p)
 }
 
+func (s *state) isActive(param string) bool {
+	for _, p := range s.active() {
+		if p == param {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *state) cmd(param string) *exec.Cmd {
 	if c, ok := s.cmds[param]; ok {
 		return c
@@ -39,6 +80,10 @@ func (s *state) empty() bool {
 	return len(s.cmds) == 0
 }
 
+func (s *state) rotating() bool {
+	return s.transition != nil
+}
+
 func (s *state) each(f eachFunc) {
 	for p, c := range s.cmds {
 		f(p, c)
@@ -49,12 +94,50 @@ func (s *state) each(f eachFunc) {
 
 func (s *state) set(param string, cmd *exec.Cmd) {
 	s.cmds[param] = cmd
+	s.started[param] = time.Now()
+}
+
+// setRelease makes r the current release. If r is a different release, the current release becomes
+// the previous release.
+func (s *state) setRelease(r string) {
+	if r != s.release {
+		s.previousRelease = s.release
+		s.release = r
+	}
+}
+
+func (s *state) restarted(param string) {
+	s.restarts[param]++
 }
 
 func (s *state) unset(param string) {
 	delete(s.cmds, param)
+	delete(s.started, param)
 }
 
 func (s *state) rotate() {
 	s.rotation.rotate()
+	p := s.rotation.newest()
+	for _, f := range s.watchFuncs {
+		f(p)
+	}
+}
+
+// watch calls f with the newest active parameter right away, then again each time the state
+// rotates.
+func (s *state) watch(f watchFunc) {
+	s.watchFuncs = append(s.watchFuncs, f)
+	f(s.rotation.newest())
+}
+
+// begin starts a transition to the command c run with param from release.
+func (s *state) begin(param, release string, c *exec.Cmd) *transition {
+	s.transition = newTransition(param, release, c)
+	return s.transition
+}
+
+// end ends the current transition.
+func (s *state) end() {
+	close(s.transition.done)
+	s.transition = nil
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// termination is sent when a command that was sent the stop signal is still running after the stop
+// timeout.
+type termination struct {
+	param string
+	cmd   *exec.Cmd
+}
+
+// terminator sends the stop signal to commands, and reports the commands that are still running
+// after the stop timeout on expired.
+type terminator struct {
+	log    *logger
+	signal syscall.Signal
+	// timeout is the stop timeout, or 0 to wait for the commands forever.
+	timeout time.Duration
+	expired chan termination
+	// done is closed when expired stops being read.
+	done chan struct{}
+	// pending are the commands whose stop timeout has not expired yet. It is only used from the
+	// event loop, which removes the commands received on expired.
+	pending map[*exec.Cmd]bool
+}
+
+func newTerminator(l *logger, signal syscall.Signal, timeout time.Duration,
+	done chan struct{}) *terminator {
+	return &terminator{l, signal, timeout, make(chan termination), done, map[*exec.Cmd]bool{}}
+}
+
+// terminate sends the stop signal to the command c run with p, and starts its stop timeout.
+func (k *terminator) terminate(p string, c *exec.Cmd) {
+	if c == nil {
+		return
+	}
+	k.log.event("term_sent", fields{"param": p, "pid": c.Process.Pid,
+		"signal": signalName(k.signal)}, "Sending %s signal to command with parameter %q\n",
+		signalName(k.signal), p)
+	if err := signalCmd(c, k.signal); err != nil {
+		k.log.errorf(err, "Failed to send %s signal to command with parameter %q, error: %v\n",
+			signalName(k.signal), p, err)
+		return
+	}
+	if k.timeout > 0 {
+		k.pending[c] = true
+		go k.expire(termination{p, c})
+	}
+}
+
+// groupsRunning returns true if processes remain in the process group of a command whose stop
+// timeout has not expired yet, so that they are killed before alternate exits.
+func (k *terminator) groupsRunning() bool {
+	for c := range k.pending {
+		if groupRunning(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *terminator) expire(t termination) {
+	select {
+	case <-time.After(k.timeout):
+		select {
+		case k.expired <- t:
+		case <-k.done:
+		}
+	case <-k.done:
+	}
+}
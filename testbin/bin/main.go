@@ -55,7 +55,7 @@ func exitAfterStart(delay time.Duration, exit chan struct{}) {
 }
 
 func exitAfterSigterm(delay time.Duration, exit chan struct{}) {
-	term := make(chan os.Signal)
+	term := make(chan os.Signal, 1)
 	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
 	for _ = range term {
 		if delay >= 0 {
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// tomlToJSON converts a TOML config file to the equivalent JSON object, so that both formats are
+// decoded and validated the same way. Only the subset of TOML that config files need is supported:
+// top-level key/value pairs whose values are strings, integers, booleans or arrays of them.
+// Tables, floats, dates and multi-line strings are rejected.
+func tomlToJSON(b []byte) ([]byte, error) {
+	p := &tomlParser{s: string(b), line: 1}
+	values := map[string]interface{}{}
+	for {
+		p.skip(true)
+		if p.eof() {
+			break
+		}
+		line := p.line
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		p.skip(false)
+		if !p.consume('=') {
+			return nil, p.errorf("expected '=' after key %s", configKey(key))
+		}
+		p.skip(false)
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("duplicate key %s on line %d", configKey(key), line)
+		}
+		values[key] = v
+		p.skip(false)
+		if !p.eof() && !p.consume('\n') {
+			return nil, p.errorf("expected a new line after the value of key %s", configKey(key))
+		}
+	}
+	return json.Marshal(values)
+}
+
+// tomlParser reads TOML from s, keeping track of the current line for the error messages.
+type tomlParser struct {
+	s    string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("syntax error on line %d: %s", p.line, fmt.Sprintf(format, a...))
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// consume skips the next byte and returns true if it is c, or returns false otherwise.
+func (p *tomlParser) consume(c byte) bool {
+	if p.peek() != c {
+		return false
+	}
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return true
+}
+
+// skip skips the spaces and comments, and the new lines too if newlines is true.
+func (p *tomlParser) skip(newlines bool) {
+	for !p.eof() {
+		switch c := p.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.pos++
+			}
+		case c == '\n' && newlines:
+			p.consume('\n')
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) key() (string, error) {
+	switch p.peek() {
+	case '[':
+		return "", p.errorf("tables are not supported")
+	case '"', '\'':
+		return p.string()
+	}
+	start := p.pos
+	for !p.eof() && isBareKeyChar(p.peek()) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a key, got '%c'", p.peek())
+	}
+	return p.s[start:p.pos], nil
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' ||
+		c == '_'
+}
+
+func (p *tomlParser) value() (interface{}, error) {
+	switch p.peek() {
+	case '"', '\'':
+		return p.string()
+	case '[':
+		return p.array()
+	}
+
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(" \t\r\n,]#", rune(p.peek())) {
+		p.pos++
+	}
+	token := p.s[start:p.pos]
+	switch token {
+	case "":
+		return nil, p.errorf("missing value")
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	n, err := strconv.ParseInt(strings.Replace(token, "_", "", -1), 10, 64)
+	if err != nil {
+		return nil, p.errorf("unsupported value '%s'", token)
+	}
+	return n, nil
+}
+
+func (p *tomlParser) array() ([]interface{}, error) {
+	p.consume('[')
+	a := []interface{}{}
+	for {
+		p.skip(true)
+		if p.consume(']') {
+			return a, nil
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+		p.skip(true)
+		if !p.consume(',') && p.peek() != ']' {
+			return nil, p.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// string reads a basic string in double quotes, with escape sequences, or a literal string in
+// single quotes, without.
+func (p *tomlParser) string() (string, error) {
+	quote := p.peek()
+	if strings.HasPrefix(p.s[p.pos:], strings.Repeat(string(quote), 3)) {
+		return "", p.errorf("multi-line strings are not supported")
+	}
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.peek()
+		p.pos++
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && quote == '"':
+			r, err := p.escape()
+			if err != nil {
+				return "", err
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+var tomlEscapes = map[byte]rune{'b': '\b', 't': '\t', 'n': '\n', 'f': '\f', 'r': '\r', '"': '"',
+	'\\': '\\'}
+
+// escape reads the escape sequence following a backslash in a basic string.
+func (p *tomlParser) escape() (rune, error) {
+	c := p.peek()
+	p.pos++
+	if r, ok := tomlEscapes[c]; ok {
+		return r, nil
+	}
+	size := map[byte]int{'u': 4, 'U': 8}[c]
+	if size == 0 || p.pos+size > len(p.s) {
+		return 0, p.errorf("invalid escape sequence '\\%c'", c)
+	}
+	hex := p.s[p.pos : p.pos+size]
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || !utf8.ValidRune(rune(n)) {
+		return 0, p.errorf("invalid escape sequence '\\%c%s'", c, hex)
+	}
+	p.pos += size
+	return rune(n), nil
+}
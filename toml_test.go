@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestTOMLToJSON(t *testing.T) {
+	tests := []struct {
+		iTOML string
+		oJSON string
+		oErr  string
+	}{
+		{"", "{}", ""},
+		{
+			"# Comment\ncommand = \"cmd \\\"%alt\\\"\" # Trailing comment\n\n" +
+				"parameters = [\n  '3000',\n  \"3001\", # Blue\n]\noverlap = \"5s\"\n",
+			`{"command":"cmd \"%alt\"","overlap":"5s","parameters":["3000","3001"]}`, "",
+		},
+		{
+			"shell = true\nlog-compress = false\nrestart-limit = 1_000\n\"dir\" = 'C:\\srv'\n",
+			`{"dir":"C:\\srv","log-compress":false,"restart-limit":1000,"shell":true}`, "",
+		},
+		{`env = ["SLOT=\u00e9"]`, `{"env":["SLOT=é"]}`, ""},
+		{"[alternate]\ncommand = \"cmd\"", "", "syntax error on line 1: tables are not supported"},
+		{"command \"cmd\"", "", `syntax error on line 1: expected '=' after key "command"`},
+		{"overlap = 1.5", "", "syntax error on line 1: unsupported value '1.5'"},
+		{"command = \"cmd", "", "syntax error on line 1: unterminated string"},
+		{"command = \"\"\"cmd\"\"\"", "", "syntax error on line 1: multi-line strings are not " +
+			"supported"},
+		{"command = \"\\x\"", "", `syntax error on line 1: invalid escape sequence '\x'`},
+		{"parameters = [\n\"3000\"\n\"3001\"]", "", "syntax error on line 3: expected ',' or ']' " +
+			"in array"},
+		{"shell = true false", "", `syntax error on line 1: expected a new line after the value ` +
+			`of key "shell"`},
+		{"overlap = \"0\"\noverlap = \"5s\"", "", `duplicate key "overlap" on line 2`},
+		{"overlap =", "", "syntax error on line 1: missing value"},
+	}
+
+	for i, test := range tests {
+		b, err := tomlToJSON([]byte(test.iTOML))
+		if !sameError(err, test.oErr) {
+			t.Errorf("For test #%d with TOML %q, expected err to be '%s', but was '%s'", i,
+				test.iTOML, test.oErr, err)
+		}
+		if err == nil && string(b) != test.oJSON {
+			t.Errorf("For test #%d with TOML %q, expected JSON %s, but was %s", i, test.iTOML,
+				test.oJSON, b)
+		}
+	}
+}
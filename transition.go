@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// transition is a rotation in progress, from the moment the next command is run until it either
+// takes over from the current command or is rolled back. When several instances are active, a
+// rotation replaces them one at a time, and each replacement is a step with its own transition.
+type transition struct {
+	param   string
+	release string
+	cmd     *exec.Cmd
+	// step is the number of the replacement, from 1 to steps.
+	step  int
+	steps int
+	// exit is set if the command exited before the transition ended.
+	exit *exitEvent
+	// started is when the rotation started. It is carried over from step to step.
+	started time.Time
+	// overlapping is true once the overlap with the current command has started.
+	overlapping bool
+	// done is closed when the transition ends, to stop any pending readiness probe.
+	done chan struct{}
+	// waiters receive the result of the rotation when the transition ends.
+	waiters []chan controlReply
+}
+
+func newTransition(param, release string, c *exec.Cmd) *transition {
+	return &transition{param, release, c, 1, 1, nil, time.Now(), false, make(chan struct{}),
+		nil}
+}
+
+// haltReason adds to reason how many instances were replaced before a rotation with several steps
+// halted at the given step.
+func haltReason(reason string, step, steps int) string {
+	if steps == 1 {
+		return reason
+	}
+	return fmt.Sprintf("%s, roll-out halted after replacing %d of %d instances", reason, step-1,
+		steps)
+}
+
+type rotationOutcome string
+
+const (
+	rotationSucceeded  rotationOutcome = "succeeded"
+	rotationRolledBack rotationOutcome = "rolled back"
+	rotationCancelled  rotationOutcome = "cancelled"
+	rotationFailed     rotationOutcome = "failed"
+	rotationInProgress rotationOutcome = "already in progress"
+)
+
+// rotationResult is the outcome of a rotation to param. reason explains why the rotation did not
+// succeed, and is empty otherwise. exit is set if the next command exited before the rotation
+// ended. duration is how long the rotation took, or 0 if it never started.
+type rotationResult struct {
+	param    string
+	outcome  rotationOutcome
+	reason   string
+	exit     *exitEvent
+	duration time.Duration
+}
+
+func (r rotationResult) String() string {
+	s := fmt.Sprintf("Rotation to parameter %q %s", r.param, r.outcome)
+	if r.reason != "" {
+		s += ", reason: " + r.reason
+	}
+	if r.exit != nil {
+		s += fmt.Sprintf(" (next command %s)", r.exit.usage())
+	}
+	return s
+}
+
+// report logs the result, and sends it to the given waiters.
+func report(l *logger, r rotationResult, waiters ...chan controlReply) {
+	f := fields{"param": r.param, "outcome": string(r.outcome),
+		"duration_ms": milliseconds(r.duration)}
+	if r.reason != "" {
+		f["reason"] = r.reason
+	}
+	l.event("rotate_end", f, "%v", r)
+	for _, w := range waiters {
+		if w != nil {
+			w <- controlReply{r.outcome == rotationSucceeded, r.String()}
+		}
+	}
+}